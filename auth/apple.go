@@ -0,0 +1,375 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/log"
+	"github.com/Loofort/ios-back/reply"
+	"github.com/Loofort/ios-back/usage"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// GrantIDToken is the grant_type of Sign in with Apple, the request has id_token and nonce.
+	GrantIDToken = "id_token"
+
+	AppleIssuer   = "https://appleid.apple.com"
+	AppleKeysURL  = "https://appleid.apple.com/auth/keys"
+	appleCacheTTL = 24 * time.Hour
+	// unknown kid triggers keys refetch, but not more often than this
+	appleRefetchInterval = time.Minute
+)
+
+// AppleIDError is returned if identity token is invalid.
+type AppleIDError struct {
+	error
+}
+
+// AppleIDClaims is the payload of Sign in with Apple identity token.
+// see https://developer.apple.com/documentation/sign_in_with_apple/sign_in_with_apple_rest_api/authenticating_users_with_sign_in_with_apple
+type AppleIDClaims struct {
+	jwt.StandardClaims
+	Nonce          string      `json:"nonce"`
+	NonceSupported bool        `json:"nonce_supported"`
+	Email          string      `json:"email"`
+	EmailVerified  interface{} `json:"email_verified"`   // "true" or true
+	IsPrivateEmail interface{} `json:"is_private_email"` // "true" or true
+}
+
+// AppleIDVerifier verifies Sign in with Apple identity tokens.
+// It caches the Apple public keys, so use it by pointer.
+type AppleIDVerifier struct {
+	// Keys is url or file path of Apple public keys (JWKS), AppleKeysURL by default.
+	// The file is handy for tests.
+	Keys string
+	// Audiences are the bundle ids (client ids) the tokens are accepted for, it's required.
+	// The token of any other app is signed by Apple too, so the posted bundle id can't be trusted alone.
+	Audiences []string
+	// Client is used to fetch the keys, if omit the default is used.
+	Client *http.Client
+	// CacheTTL is how long the keys are cached, 24 hours by default.
+	CacheTTL time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time     // when the keys were fetched
+	attempted time.Time     // when the last fetch started
+	err       error         // the error of the last fetch
+	fetching  chan struct{} // closed when the running fetch is done
+}
+
+// Verify checks the signature, issuer, expiration, audience (bundle id) and nonce of the identity token.
+// The audience must be one of Audiences.
+// The nonce is the raw one generated by the app, the app passes its sha256 hex to the authorization request,
+// so the token carries the hash and the token leaked alone can't be used.
+// Note it doesn't stop the replay of the token together with the nonce within the token lifetime.
+func (v *AppleIDVerifier) Verify(ctx context.Context, idToken, audience, nonce string) (AppleIDClaims, error) {
+	claims := AppleIDClaims{}
+	if len(v.Audiences) == 0 {
+		return claims, errors.New("apple id audiences are not configured")
+	}
+
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+			return nil, AppleIDError{fmt.Errorf("unexpected signing method %s", token.Method.Alg())}
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.key(ctx, kid)
+	}
+
+	if _, err := jwt.ParseWithClaims(idToken, &claims, keyFunc); err != nil {
+		if verr, ok := err.(*jwt.ValidationError); ok && verr.Errors&jwt.ValidationErrorUnverifiable != 0 {
+			if _, ok := verr.Inner.(AppleIDError); !ok {
+				// unable to get the keys, it's system error
+				return claims, verr.Inner
+			}
+		}
+		return claims, AppleIDError{err}
+	}
+
+	switch {
+	case claims.Issuer != AppleIssuer:
+		return claims, AppleIDError{fmt.Errorf("unexpected issuer (iss) %q", claims.Issuer)}
+	case claims.Audience != audience || !stringInSlice(claims.Audience, v.Audiences):
+		return claims, AppleIDError{fmt.Errorf("unexpected audience (aud) %q", claims.Audience)}
+	case claims.Subject == "":
+		return claims, AppleIDError{errors.New("subject (sub) is missing")}
+	case nonce == "" || claims.Nonce == "":
+		return claims, AppleIDError{errors.New("nonce is missing")}
+	case claims.Nonce != sha256Hex(nonce):
+		return claims, AppleIDError{errors.New("nonce mismatch")}
+	}
+	return claims, nil
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// key returns the public key by kid, the keys are refetched if the cache is outdated or kid is unknown,
+// but not more often than appleRefetchInterval. The keys are fetched by one request at a time without holding the lock,
+// the others keep using the cached keys, and wait for the fetch only if kid is unknown.
+// If the fetch fails the cached keys are still used, the error is returned only for unknown kid.
+func (v *AppleIDVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	ttl := v.CacheTTL
+	if ttl == 0 {
+		ttl = appleCacheTTL
+	}
+
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	if ok && time.Since(v.fetched) <= ttl {
+		v.mu.Unlock()
+		return key, nil
+	}
+
+	if done := v.fetching; done != nil {
+		v.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return v.cached(kid)
+	}
+	if time.Since(v.attempted) < appleRefetchInterval {
+		defer v.mu.Unlock()
+		return v.cached(kid)
+	}
+
+	done := make(chan struct{})
+	v.fetching, v.attempted = done, time.Now()
+	v.mu.Unlock()
+
+	keys, err := v.fetch(ctx)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fetching, v.err = nil, err
+	if err == nil {
+		v.keys, v.fetched = keys, time.Now()
+	}
+	close(done)
+
+	if err != nil && ok {
+		log.Error(ctx, "unable to refetch apple keys, the cached ones are used", "err", err, "type", "auth.apple")
+	}
+	return v.cached(kid)
+}
+
+// cached returns the cached key, if kid is unknown it returns the error of the last fetch if any.
+// v.mu must be held.
+func (v *AppleIDVerifier) cached(kid string) (*rsa.PublicKey, error) {
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if v.err != nil {
+		return nil, v.err
+	}
+	return nil, AppleIDError{fmt.Errorf("unknown key %q", kid)}
+}
+
+func (v *AppleIDVerifier) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	source := v.Keys
+	if source == "" {
+		source = AppleKeysURL
+	}
+
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		data, err = v.download(ctx, source)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get apple keys: %v", err)
+	}
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("unable to decode apple keys: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		key, err := rsaPublicKey(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode apple key %q: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (v *AppleIDVerifier) download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http response code: %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func rsaPublicKey(jwk JWK) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// signInWithApple issues the token for Apple user.
+// Without receipt the token is limited. With receipt the subscriptions are checked as usual,
+// and bound to the Apple user, see appleIdentity.
+// The receipt already bound to another Apple user is refused, otherwise anyone having the receipt
+// could link own Apple ID to the account and keep the access without the receipt.
+// The receipt of the account without Apple user is bound to the first one signed in with it,
+// set DeviceCheck so the receipt is accepted only from the device it's issued for.
+func (a Authenticator) signInWithApple(w http.ResponseWriter, r *http.Request) {
+	ctx := usage.NewContext(r.Context(), "grant_type", GrantIDToken)
+
+	if a.AppleID == nil || len(a.AppleID.Audiences) == 0 {
+		reply.Err(ctx, w, http.StatusBadRequest, "unsupported grant_type")
+		return
+	}
+
+	idToken := r.FormValue("id_token")
+	if idToken == "" {
+		reply.Err(ctx, w, http.StatusBadRequest, "please provide id_token")
+		return
+	}
+	bundleID := r.FormValue("bundle_id")
+	if bundleID == "" {
+		reply.Err(ctx, w, http.StatusBadRequest, "please provide correct bundle_id")
+		return
+	}
+	idForVendor := r.FormValue("identifier_for_vendor")
+
+	ctx = usage.NewContext(ctx,
+		"bundle_id", bundleID,
+		"device_id", idForVendor,
+	)
+
+	if len(a.KnownBundles) > 0 && !stringInSlice(bundleID, a.KnownBundles) {
+		reply.Err(ctx, w, http.StatusForbidden, "unregistered bundle")
+		return
+	}
+	a, ok := a.forTenant(bundleID)
+	if !ok {
+		reply.Err(ctx, w, http.StatusForbidden, "unregistered bundle")
+		return
+	}
+	ctx = usage.NewContext(ctx, "tenant", a.tenant)
+
+	apple, err := a.AppleID.Verify(ctx, idToken, bundleID, r.FormValue("nonce"))
+	if err != nil {
+		if _, ok := err.(AppleIDError); ok {
+			reply.Err(ctx, w, http.StatusBadRequest, "invalid id_token: "+err.Error())
+			return
+		}
+		log.Error(ctx, "unable to verify id_token", "err", err, "type", "auth.apple")
+		reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	ctx = usage.NewContext(ctx, "apple_sub", apple.Subject)
+
+	a.Identity = appleIdentity{sub: apple.Subject, base: a.Identity}
+
+	// the receipt is optional
+	receipt, _ := readReceipt(r)
+	if len(receipt) == 0 {
+		// signed in, but not paid; the device isn't verified without receipt, so it's not linked
+		user, err := a.Identity.UID(ctx, "", nil)
+		if err != nil {
+			log.Error(ctx, "unable to identify user", "err", err, "type", "auth.identity")
+			reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		ReplyClaims(ctx, w, a.Keys, a.newClaims(time.Now().Add(a.Period), user, 1))
+		return
+	}
+
+	if a.DeviceCheck != nil {
+		if errmsg := CheckDevice(ctx, *a.DeviceCheck, receipt, bundleID, idForVendor); errmsg != "" {
+			reply.Err(ctx, w, http.StatusForbidden, errmsg)
+			return
+		}
+	}
+
+	ent, ok := a.entitle(ctx, w, receipt, idForVendor)
+	if !ok {
+		return
+	}
+
+	claims := a.newClaims(ent.ExpiresAt, ent.User, 0)
+	claims.Entitlements = ent.Entitlements
+	claims.Provisional = ent.Provisional
+	a.replyTokens(ctx, w, claims, RefreshToken{
+		BundleID:    bundleID,
+		IDForVendor: idForVendor,
+		AppleSub:    apple.Subject,
+		Receipt:     ent.Receipt,
+	}, nil)
+}
+
+// appleIdentity makes the Apple user id the base of uid.
+// With AccountIdentity the Apple user owns the account and the subscriptions are linked to it,
+// so the receipt presented later without id_token resolves to the same user.
+// It fails with ErrAccountOwned if the subscriptions are linked to the account of another Apple user.
+// Otherwise uid is derived from Apple user id only.
+type appleIdentity struct {
+	sub  string
+	base Identity
+}
+
+func (ai appleIdentity) UID(ctx context.Context, device string, subscriptions []iap.AutoRenewable) ([]byte, error) {
+	if acc, ok := ai.base.(AccountIdentity); ok {
+		return acc.link(ctx, "apple:"+ai.sub, device, subscriptions)
+	}
+
+	user := sha256.Sum224([]byte("apple:" + ai.sub))
+	return user[:], nil
+}
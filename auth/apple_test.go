@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignInWithApple(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	apple := NewRSAKey("apple-1", key)
+
+	// apple keys are taken from file
+	jwk, _ := apple.JWK()
+	data, err := json.Marshal(map[string]interface{}{"keys": []JWK{jwk}})
+	require.NoError(t, err)
+	keysFile := filepath.Join(t.TempDir(), "apple_keys.json")
+	require.NoError(t, ioutil.WriteFile(keysFile, data, 0600))
+
+	appStore := appleServer(t, subscription("basic.monthly", "1", time.Now().Add(24*time.Hour)))
+	store, err := NewFileAccountStore("")
+	require.NoError(t, err)
+
+	a := Authenticator{
+		Keys:         testKeys,
+		Period:       time.Hour,
+		Receipts:     appStore.ReceiptService(),
+		KnownBundles: []string{"com.myfirm.myapp"},
+		Identity:     AccountIdentity{Store: store},
+		AppleID:      &AppleIDVerifier{Keys: keysFile, Audiences: []string{"com.myfirm.myapp", "com.myfirm.other"}},
+	}
+
+	idToken := func(modify func(c *AppleIDClaims)) string {
+		claims := AppleIDClaims{Nonce: sha256Hex("raw nonce")}
+		claims.Issuer = AppleIssuer
+		claims.Audience = "com.myfirm.myapp"
+		claims.Subject = "001234.abcdef"
+		claims.ExpiresAt = time.Now().Add(10 * time.Minute).Unix()
+		if modify != nil {
+			modify(&claims)
+		}
+		token, err := KeySet{Signing: apple}.Sign(claims)
+		require.NoError(t, err)
+		return token
+	}
+	token := func(params map[string]string) (int, []byte) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, tokenRequest(t, params))
+		return w.Code, w.Body.Bytes()
+	}
+
+	// signed in without subscription
+	code, body := token(map[string]string{"grant_type": GrantIDToken, "id_token": idToken(nil), "nonce": "raw nonce", "receipt": ""})
+	require.Equal(t, http.StatusOK, code, string(body))
+	limited := parseToken(t, body)
+	require.Equal(t, ScopeLimited, limited.Scope)
+
+	// the receipt is attached to the apple user
+	code, body = token(map[string]string{"grant_type": GrantIDToken, "id_token": idToken(nil), "nonce": "raw nonce"})
+	require.Equal(t, http.StatusOK, code, string(body))
+	full := parseToken(t, body)
+	require.Equal(t, ScopeAll, full.Scope)
+	require.Equal(t, limited.UID, full.UID)
+
+	// and the same receipt on another device without sign in resolves to the apple user
+	code, body = token(map[string]string{"identifier_for_vendor": "another-device"})
+	require.Equal(t, http.StatusOK, code, string(body))
+	require.Equal(t, limited.UID, parseToken(t, body).UID)
+
+	// another apple user on the same device doesn't get the account
+	code, body = token(map[string]string{"grant_type": GrantIDToken, "id_token": idToken(func(c *AppleIDClaims) { c.Subject = "005678.fedcba" }), "nonce": "raw nonce", "receipt": ""})
+	require.Equal(t, http.StatusOK, code, string(body))
+	require.NotEqual(t, limited.UID, parseToken(t, body).UID)
+
+	// the receipt is bound to the apple user, another one can't take the account over
+	code, body = token(map[string]string{"grant_type": GrantIDToken, "id_token": idToken(func(c *AppleIDClaims) { c.Subject = "009999.aaaaaa" }), "nonce": "raw nonce"})
+	require.Equal(t, http.StatusForbidden, code, string(body))
+	require.Contains(t, string(body), "receipt is linked to another account")
+	// and the one having the account keeps it
+	code, body = token(map[string]string{"grant_type": GrantIDToken, "id_token": idToken(func(c *AppleIDClaims) { c.Subject = "005678.fedcba" }), "nonce": "raw nonce"})
+	require.Equal(t, http.StatusOK, code, string(body))
+	require.NotEqual(t, limited.UID, parseToken(t, body).UID)
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, AppleIDClaims{})
+	forged.Header["kid"] = "apple-1"
+	forgedToken, err := forged.SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name      string
+		idToken   string
+		nonce     string
+		expectMsg string
+	}{
+		{"wrong nonce", idToken(nil), "another nonce", "nonce mismatch"},
+		{"hashed nonce", idToken(nil), sha256Hex("raw nonce"), "nonce mismatch"},
+		{"no nonce", idToken(nil), "", "nonce is missing"},
+		{"another app", idToken(func(c *AppleIDClaims) { c.Audience = "com.myfirm.other" }), "raw nonce", "(aud)"},
+		{"unknown app", idToken(func(c *AppleIDClaims) { c.Audience = "com.evil.app" }), "raw nonce", "(aud)"},
+		{"another issuer", idToken(func(c *AppleIDClaims) { c.Issuer = "https://example.com" }), "raw nonce", "(iss)"},
+		{"expired", idToken(func(c *AppleIDClaims) { c.ExpiresAt = time.Now().Add(-time.Minute).Unix() }), "raw nonce", "expired"},
+		{"forged", forgedToken, "raw nonce", "signing method"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, body := token(map[string]string{"grant_type": GrantIDToken, "id_token": tc.idToken, "nonce": tc.nonce, "receipt": ""})
+			require.Equal(t, http.StatusBadRequest, code, string(body))
+			require.Contains(t, string(body), tc.expectMsg)
+		})
+	}
+
+	// any app's token is signed by Apple, so the audiences must be configured
+	a.AppleID = &AppleIDVerifier{Keys: keysFile}
+	code, body = token(map[string]string{"grant_type": GrantIDToken, "id_token": idToken(nil), "nonce": "raw nonce", "receipt": ""})
+	require.Equal(t, http.StatusBadRequest, code, string(body))
+	require.Contains(t, string(body), "unsupported grant_type")
+}
+
+func TestAppleIDVerifierKeysUnavailable(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idToken, err := KeySet{Signing: NewRSAKey("apple-1", key)}.Sign(AppleIDClaims{})
+	require.NoError(t, err)
+
+	// it's system error, not the invalid token
+	v := &AppleIDVerifier{Keys: filepath.Join(t.TempDir(), "absent.json"), Audiences: []string{"com.myfirm.myapp"}}
+	_, err = v.Verify(context.Background(), idToken, "com.myfirm.myapp", "nonce")
+	require.Error(t, err)
+	_, ok := err.(AppleIDError)
+	require.False(t, ok, err)
+}
+
+func TestAppleIDVerifierKeysRefetch(t *testing.T) {
+	sign := func(kid string) (JWK, string) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		claims := AppleIDClaims{Nonce: sha256Hex("raw nonce")}
+		claims.Issuer = AppleIssuer
+		claims.Audience = "com.myfirm.myapp"
+		claims.Subject = "001234.abcdef"
+		claims.ExpiresAt = time.Now().Add(10 * time.Minute).Unix()
+		token, err := KeySet{Signing: NewRSAKey(kid, key)}.Sign(claims)
+		require.NoError(t, err)
+		jwk, _ := NewRSAKey(kid, key).JWK()
+		return jwk, token
+	}
+	jwk1, token1 := sign("apple-1")
+	jwk2, token2 := sign("apple-2")
+
+	var mu sync.Mutex
+	keys := []JWK{jwk1}
+	fail := false
+	release := make(chan struct{}) // the fetch is blocked until it's closed
+	close(release)
+	requests := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		mu.Lock()
+		wait, failed, jwks := release, fail, keys
+		mu.Unlock()
+		<-wait
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks})
+	}))
+	defer srv.Close()
+
+	v := &AppleIDVerifier{Keys: srv.URL, Audiences: []string{"com.myfirm.myapp"}}
+	verify := func(token string) error {
+		_, err := v.Verify(context.Background(), token, "com.myfirm.myapp", "raw nonce")
+		return err
+	}
+	// makes the cache outdated and allows the refetch
+	expire := func() {
+		v.mu.Lock()
+		v.fetched = v.fetched.Add(-appleCacheTTL - time.Minute)
+		v.attempted = v.attempted.Add(-appleRefetchInterval - time.Minute)
+		v.mu.Unlock()
+	}
+
+	require.NoError(t, verify(token1))
+	require.Len(t, requests, 1)
+
+	// Apple is down, the outdated keys are still used
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	expire()
+	require.NoError(t, verify(token1))
+	require.Len(t, requests, 2)
+
+	// but unknown kid fails with system error, and Apple isn't asked again right away
+	err := verify(token2)
+	require.Error(t, err)
+	require.False(t, isAppleIDError(err), err)
+	require.Len(t, requests, 2)
+
+	// the new key is fetched by one request, the known key isn't blocked meanwhile
+	<-requests
+	<-requests
+	mu.Lock()
+	fail, keys, release = false, []JWK{jwk1, jwk2}, make(chan struct{})
+	mu.Unlock()
+	expire()
+	errs := make(chan error, 2)
+	go func() { errs <- verify(token2) }()
+	<-requests
+	go func() { errs <- verify(token2) }()
+	require.NoError(t, verify(token1))
+
+	mu.Lock()
+	close(release)
+	mu.Unlock()
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+	require.Len(t, requests, 0)
+
+	// the key unknown to Apple is invalid token
+	_, token3 := sign("apple-3")
+	expire()
+	require.True(t, isAppleIDError(verify(token3)))
+}
+
+func isAppleIDError(err error) bool {
+	_, ok := err.(AppleIDError)
+	return ok
+}
@@ -2,10 +2,12 @@ package auth
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,76 +20,305 @@ import (
 
 type NextHandlerBuilder func(uid string, freebie bool) http.Handler
 
-// Claims is set of values transferred by jwt
+// ClaimsHandlerBuilder is like NextHandlerBuilder, but gets all the token claims.
+type ClaimsHandlerBuilder func(claims Claims) http.Handler
+
+// Claims is set of values transferred by jwt.
+// StandardClaims.Id (jti) identifies the token, see RevocationStore.
 type Claims struct {
 	jwt.StandardClaims
-	UID     string `json:"uid,omitempty"`
-	Freebie byte   `json:"frb,omitempty"` // 0 or 1
+	UID          string   `json:"uid,omitempty"`
+	Freebie      byte     `json:"frb,omitempty"`   // 0 or 1
+	Scope        string   `json:"scope,omitempty"` // space separated scopes: "all" or "limited"
+	Entitlements []string `json:"ent,omitempty"`   // set if Authenticator has the product catalog
+	Tenant       string   `json:"tnt,omitempty"`   // bundle id of the app, set if Authenticator has tenants
+	Provisional  bool     `json:"prv,omitempty"`   // issued from the last known entitlement while Apple is unavailable
 }
 
 // AuthenticationHandler receives receipt and verifies it. Uses receipt for authenticate and authorize the user.
-// If successfully returns access token
-func AuthenticationHandler(secret string, period time.Duration, rs iap.ReceiptService, knownBundles []string, trustedDevices []string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		expireToken := time.Now().Add(period)
+// If successfully returns access token signed by keys.Signing
+// rs is usually iap.ReceiptService, see iap.Verifier for other sources.
+func AuthenticationHandler(keys KeySet, period time.Duration, rs iap.Verifier, knownBundles []string, trustedDevices []string) http.HandlerFunc {
+	a := Authenticator{
+		Keys:           keys,
+		Period:         period,
+		Receipts:       rs,
+		KnownBundles:   knownBundles,
+		TrustedDevices: trustedDevices,
+	}
+	return a.ServeHTTP
+}
 
-		scope, bundleID, idForVendor, receipt, errmsg := AuthParams(r)
-		if errmsg != "" {
-			reply.Err(ctx, w, http.StatusBadRequest, errmsg)
-		}
+// Authenticator is AuthenticationHandler with extended settings.
+type Authenticator struct {
+	Keys           KeySet
+	Period         time.Duration
+	KnownBundles   []string
+	TrustedDevices []string
+
+	// Receipts is the source of subscriptions, usually iap.ReceiptService.
+	// Use iap.LocalVerifier to skip Apple server, or iap.VerifierFunc to plug in another store.
+	Receipts iap.Verifier
+
+	// DeviceCheck if set, the receipt is verified locally before requesting Apple,
+	// and rejected if it was issued for another app or device (identifier_for_vendor).
+	DeviceCheck *iap.LocalVerifier
+
+	// Catalog if set, the best active subscription is picked per subscription group
+	// and their entitlements are put into the token.
+	Catalog *iap.Catalog
+
+	// Issuer and Audience if set, are put into iss and aud claims.
+	// Set them when several services share the keys, so the token of one is not accepted by another, see Introspector.
+	Issuer   string
+	Audience string
+
+	// Tenants if set, the app is resolved by posted bundle_id and unknown apps are rejected.
+	// The tenant settings override Receipts, Catalog and Keys.
+	Tenants Tenants
+	tenant  string
+
+	// Identity derives the user id from the subscriptions, TransactionIdentity by default.
+	Identity Identity
+
+	// AppleID if set, Sign in with Apple is supported (grant_type=id_token).
+	AppleID *AppleIDVerifier
+
+	// Aliases if set, keeps the former uid of the user who upgraded the limited token (grant_type=token-exchange).
+	Aliases AliasStore
+
+	// Refresh if set, the receipt based tokens come with refresh token.
+	// The app exchanges it for a new access token (grant_type=refresh_token) instead of uploading the receipt again.
+	Refresh RefreshStore
+	// RefreshPeriod is the refresh token lifetime, 30 days by default.
+	RefreshPeriod time.Duration
+
+	// Fallback if set, keeps the last known entitlement of every receipt.
+	// While Apple is unavailable (iap.ReceiptService.Breaker is open), the user gets provisional token from it.
+	Fallback EntitlementCache
+	// ProvisionalPeriod is the provisional token lifetime, 10 minutes by default.
+	ProvisionalPeriod time.Duration
+
+	// Revocations if set, records the user of every subscription the token is issued for,
+	// so RevokeOnNotification revokes the tokens on refund whatever Identity derived the uid.
+	// Set the store of Introspector.Revocations.
+	Revocations RevocationStore
+}
 
-		ctx = usage.NewContext(ctx,
-			"scope", scope,
-			"bundle_id", bundleID,
-			"device_id", idForVendor,
-			"receipt_len", len(receipt),
-		)
+func (a Authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	grantType := r.FormValue("grant_type")
+	switch grantType {
+	case GrantRefreshToken:
+		a.refresh(w, r)
+		return
+	case GrantIDToken:
+		a.signInWithApple(w, r)
+		return
+	}
 
-		// check if request is made on behalf of known app
-		if len(knownBundles) > 0 && !stringInSlice(bundleID, knownBundles) {
-			reply.Err(ctx, w, http.StatusForbidden, "unregistered bundle")
-			return
-		}
+	expireToken := time.Now().Add(a.Period)
 
-		if strings.Contains(scope, "limited") {
-			user := []byte(idForVendor)
-			ReplyJWT(ctx, w, secret, expireToken, user, 1)
-			return
-		}
+	scope, bundleID, idForVendor, receipt, errmsg := AuthParams(r)
+	if errmsg != "" {
+		reply.Err(ctx, w, http.StatusBadRequest, errmsg)
+		return
+	}
 
-		// check if it's trusted device, and no receipt is needed
-		if len(trustedDevices) > 0 && stringInSlice(idForVendor, trustedDevices) {
-			user := []byte(idForVendor)
-			ReplyJWT(ctx, w, secret, expireToken, user, 0)
+	ctx = usage.NewContext(ctx,
+		"scope", scope,
+		"bundle_id", bundleID,
+		"device_id", idForVendor,
+		"receipt_len", len(receipt),
+	)
+
+	// check if request is made on behalf of known app
+	if len(a.KnownBundles) > 0 && !stringInSlice(bundleID, a.KnownBundles) {
+		reply.Err(ctx, w, http.StatusForbidden, "unregistered bundle")
+		return
+	}
+
+	a, ok := a.forTenant(bundleID)
+	if !ok {
+		reply.Err(ctx, w, http.StatusForbidden, "unregistered bundle")
+		return
+	}
+	ctx = usage.NewContext(ctx, "tenant", a.tenant)
+
+	// the limited token is exchanged for the full one, its uid becomes the alias of the paid user
+	alias := ""
+	if grantType == GrantTokenExchange {
+		if alias, ok = a.exchangeSubject(ctx, w, r, idForVendor); !ok {
 			return
 		}
+		ctx = usage.NewContext(ctx, "alias", alias)
+	} else if strings.Contains(scope, ScopeLimited) {
+		user := []byte(idForVendor)
+		ReplyClaims(ctx, w, a.Keys, a.newClaims(expireToken, user, 1))
+		return
+	}
+
+	// check if it's trusted device, and no receipt is needed
+	if alias == "" && len(a.TrustedDevices) > 0 && stringInSlice(idForVendor, a.TrustedDevices) {
+		user := []byte(idForVendor)
+		ReplyClaims(ctx, w, a.Keys, a.newClaims(expireToken, user, 0))
+		return
+	}
 
-		// check if receipt valid, just check length
-		if len(receipt) == 0 {
-			reply.Err(ctx, w, http.StatusBadRequest, "please provide correct receipt")
+	// check if receipt valid, just check length
+	if len(receipt) == 0 {
+		reply.Err(ctx, w, http.StatusBadRequest, "please provide correct receipt")
+		return
+	}
+
+	if a.DeviceCheck != nil {
+		if errmsg := CheckDevice(ctx, *a.DeviceCheck, receipt, bundleID, idForVendor); errmsg != "" {
+			reply.Err(ctx, w, http.StatusForbidden, errmsg)
 			return
 		}
+	}
 
-		expireSubscription, user, err := AnySubscription(ctx, rs, receipt)
-		if err != nil {
-			// it's bad practice to expose internal errors, just log it.
-			log.Error(ctx, errmsg, "err", err, "type", "auth.iap")
+	ent, ok := a.entitle(ctx, w, receipt, idForVendor)
+	if !ok {
+		return
+	}
+
+	claims := a.newClaims(ent.ExpiresAt, ent.User, 0)
+	claims.Entitlements = ent.Entitlements
+	claims.Provisional = ent.Provisional
+
+	if alias != "" && a.Aliases != nil {
+		if err := a.Aliases.AddAlias(ctx, claims.UID, alias); err != nil {
+			log.Error(ctx, "unable to add alias", "err", err, "type", "auth.exchange")
 			reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 			return
 		}
-		if expireSubscription.IsZero() {
-			reply.Err(ctx, w, http.StatusForbidden, "no active subscriptions")
-			return
-		}
+	}
 
-		// set token expire date no more than subscription expiration.
-		if expireToken.After(expireSubscription) {
-			expireToken = expireSubscription
-		}
+	var extra map[string]interface{}
+	if alias != "" {
+		extra = map[string]interface{}{"issued_token_type": TokenTypeAccessToken}
+	}
+	a.replyTokens(ctx, w, claims, RefreshToken{
+		BundleID:    bundleID,
+		IDForVendor: idForVendor,
+		Receipt:     ent.Receipt,
+	}, extra)
+}
+
+// Entitlement is the result of the receipt check.
+type Entitlement struct {
+	ExpiresAt     time.Time // the token expiration: Authenticator.Period, but no more than the subscription one
+	User          []byte    // the user id, see Identity
+	Entitlements  []string  // set if Authenticator has the product catalog
+	Receipt       []byte    // the latest base64 receipt, see RefreshToken
+	Subscriptions []iap.AutoRenewable
+	Provisional   bool // taken from Authenticator.Fallback while Apple is unavailable
+}
+
+// ErrNoSubscriptions is returned by Entitle if the receipt has no active subscriptions.
+var ErrNoSubscriptions = errors.New("no active subscriptions")
+
+// Entitle checks the receipt has active subscriptions and derives the user from them.
+// The device is identifier_for_vendor the receipt is checked for, see CheckDevice.
+// It's passed to the Identity only if DeviceCheck is set, the unverified device can't be trusted to link the user.
+// It's the core of the token request, use it to authorize the user without HTTP.
+func (a Authenticator) Entitle(ctx context.Context, receipt []byte, device string) (Entitlement, error) {
+	ent := Entitlement{ExpiresAt: time.Now().Add(a.Period)}
+	if a.Receipts == nil {
+		return ent, errors.New("receipt verifier is not set")
+	}
+
+	subscriptions, latest, err := a.Receipts.Subscriptions(ctx, receipt, entitledStates)
+	if iap.IsCircuitOpen(err) && a.Fallback != nil {
+		return a.provisional(ctx, receipt, err)
+	}
+	if err != nil {
+		return ent, err
+	}
+
+	var expireSubscription time.Time
+	if a.Catalog != nil {
+		expireSubscription, ent.Subscriptions, ent.Entitlements = pickCatalog(*a.Catalog, subscriptions)
+	} else {
+		expireSubscription, ent.Subscriptions = pickAny(subscriptions)
+	}
+	if expireSubscription.IsZero() {
+		return ent, ErrNoSubscriptions
+	}
+
+	identity := a.Identity
+	if identity == nil {
+		identity = TransactionIdentity{}
+	}
+	if a.DeviceCheck == nil {
+		device = ""
+	}
+	if ent.User, err = identity.UID(ctx, device, ent.Subscriptions); err != nil {
+		return ent, IdentityError{err}
+	}
+	// the token of unknown user couldn't be revoked, so it's not issued
+	if err := a.addSubscribers(ctx, ent); err != nil {
+		return ent, err
+	}
+
+	// set token expire date no more than subscription expiration.
+	if ent.ExpiresAt.After(expireSubscription) {
+		ent.ExpiresAt = expireSubscription
+	}
+	ent.Receipt = latest
+	a.remember(ctx, receipt, ent)
+	return ent, nil
+}
+
+// IdentityError is returned by Entitle if Identity fails.
+type IdentityError struct {
+	error
+}
+
+// entitle is Entitle replying with error itself, it returns false if user is not entitled.
+func (a Authenticator) entitle(ctx context.Context, w http.ResponseWriter, receipt []byte, device string) (Entitlement, bool) {
+	ent, err := a.Entitle(ctx, receipt, device)
+	if err == nil {
+		return ent, true
+	}
+
+	if err == ErrNoSubscriptions {
+		reply.Err(ctx, w, http.StatusForbidden, err.Error())
+		return ent, false
+	}
+	if ierr, ok := err.(IdentityError); ok && ierr.error == ErrAccountOwned {
+		reply.Err(ctx, w, http.StatusForbidden, "receipt is linked to another account")
+		return ent, false
+	}
+	if _, ok := err.(IdentityError); ok {
+		log.Error(ctx, "unable to identify user", "err", err, "type", "auth.identity")
+	} else {
+		// it's bad practice to expose internal errors, just log it.
+		log.Error(ctx, "unable to get subscriptions", "err", err, "type", "auth.iap")
+	}
+	reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	return ent, false
+}
+
+// CheckDevice verifies receipt locally and checks it was issued for the app and the device.
+// It prevents using of receipt copied from another device.
+func CheckDevice(ctx context.Context, lv iap.LocalVerifier, receipt []byte, bundleID, idForVendor string) (errmsg string) {
+	lr, err := lv.Verify(receipt)
+	if err != nil {
+		// it's either system error or hacker attack
+		log.Error(ctx, "invalid receipt", "err", err, "type", "auth.receipt")
+		return "invalid receipt"
+	}
 
-		ReplyJWT(ctx, w, secret, expireToken, user, 0)
+	if lr.BundleID != bundleID {
+		return "receipt is issued for another app"
 	}
+
+	if err := lr.CheckDeviceHash(idForVendor); err != nil {
+		return "receipt is issued for another device"
+	}
+	return ""
 }
 
 func AuthParams(r *http.Request) (scope, bundleID, idForVendor string, receipt []byte, string string) {
@@ -112,44 +343,121 @@ func AuthParams(r *http.Request) (scope, bundleID, idForVendor string, receipt [
 	return scope, bundleID, idForVendor, receipt, errmsg
 }
 
+// entitledStates are subscriptions giving access, including expired ones in billing grace period
+const entitledStates = iap.ARActive | iap.ARFree | iap.ARGracePeriod
+
 // AnySubscription check if user has any paid subscription.
 // BUt in general you could have more than one auto-renewable subscription.
-func AnySubscription(ctx context.Context, rs iap.ReceiptService, receipt []byte) (time.Time, []byte, error) {
-	// get all subscriptions, including expired (not sure about canceled)
-	subscriptions, err := rs.GetAutoRenewableIAPs(ctx, receipt, iap.ARActive|iap.ARFree)
+// The user id is derived by TransactionIdentity.
+func AnySubscription(ctx context.Context, rs iap.Verifier, receipt []byte) (time.Time, []byte, error) {
+	subscriptions, _, err := rs.Subscriptions(ctx, receipt, entitledStates)
 	if err != nil {
 		return time.Time{}, nil, err
 	}
+	expireSubscription, chosen := pickAny(subscriptions)
+	if len(chosen) == 0 {
+		return expireSubscription, nil, nil
+	}
+	return expireSubscription, subscriptionUser(chosen[0].InApp), nil
+}
+
+func pickAny(subscriptions []iap.AutoRenewable) (time.Time, []iap.AutoRenewable) {
 	if len(subscriptions) == 0 {
-		return time.Time{}, nil, err
+		return time.Time{}, nil
 	}
 
 	sbs := subscriptions[0]
-	// set token expire date no more than subscription expiration.
-	expireSubscription := sbs.SubscriptionExpirationDate.Time
+	// set token expire date no more than subscription expiration (or the end of grace period).
+	expireSubscription := sbs.EntitledUntil()
+	return expireSubscription, subscriptions[:1]
+}
 
-	// calculate user id:
-	//  - use OriginalTransactionID as base for user id
-	//  - if your API allow free users (without IAP), you could use identifierForVendor (aka device id)
-	// todo: clarify uncertainty:
-	//  1) OriginalTransactionID may not be unique if user has canceled purchase. Solution - add OriginalPurchaseDate (simple)
-	//  2) OriginalTransactionID may not be unique across multiple devices (or even behave like identifierForVendor ). Solution - involve WebOrderLineItemID (hard)
-	user := sha256.Sum224([]byte(sbs.OriginalTransactionID + sbs.OriginalPurchaseDate.String()))
+// CatalogSubscriptions picks the best active subscription per subscription group and returns their entitlements.
+// The expiration is the earliest of chosen subscriptions, so no entitlement outlives its subscription.
+// Subscriptions of products unknown to catalog are ignored.
+// The user id is derived by TransactionIdentity.
+func CatalogSubscriptions(ctx context.Context, rs iap.Verifier, catalog iap.Catalog, receipt []byte) (time.Time, []byte, []string, error) {
+	subscriptions, _, err := rs.Subscriptions(ctx, receipt, entitledStates)
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	expireSubscription, best, entitlements := pickCatalog(catalog, subscriptions)
+	if len(best) == 0 {
+		return expireSubscription, nil, nil, nil
+	}
+	return expireSubscription, subscriptionUser(best[0].InApp), entitlements, nil
+}
 
-	return expireSubscription, user[:], nil
+// pickCatalog returns the best subscriptions starting from the earliest original purchase,
+// so the user id derived from the first one doesn't change when the user subscribes to another group.
+func pickCatalog(catalog iap.Catalog, subscriptions []iap.AutoRenewable) (time.Time, []iap.AutoRenewable, []string) {
+	best := catalog.Best(subscriptions)
+	if len(best) == 0 {
+		return time.Time{}, nil, nil
+	}
+	sort.SliceStable(best, func(i, j int) bool {
+		if !best[i].OriginalPurchaseDate.Equal(best[j].OriginalPurchaseDate.Time) {
+			return best[i].OriginalPurchaseDate.Before(best[j].OriginalPurchaseDate.Time)
+		}
+		return best[i].OriginalTransactionID < best[j].OriginalTransactionID
+	})
+
+	expireSubscription := best[0].EntitledUntil()
+	for _, sbs := range best[1:] {
+		if sbs.EntitledUntil().Before(expireSubscription) {
+			expireSubscription = sbs.EntitledUntil()
+		}
+	}
+	return expireSubscription, best, catalog.Entitlements(best)
+}
+
+// SubscriptionUID returns the uid claim of the tokens issued for the subscription by TransactionIdentity.
+// Use it to find the user by subscription, e.g. on status update notification.
+func SubscriptionUID(sbs iap.InApp) string {
+	return base64.RawStdEncoding.EncodeToString(subscriptionUser(sbs))
 }
 
-func ReplyJWT(ctx context.Context, w http.ResponseWriter, secret string, expireToken time.Time, user []byte, freebie byte) {
-	// write claims: token body
+// NewClaims makes token claims for the user.
+func NewClaims(expireToken time.Time, user []byte, freebie byte) Claims {
 	claims := Claims{
 		UID:     base64.RawStdEncoding.EncodeToString(user),
 		Freebie: freebie,
+		Scope:   ScopeAll,
+	}
+	if freebie != 0 {
+		claims.Scope = ScopeLimited
 	}
+	claims.Id = newTokenID() // jti, to revoke the single token
+	claims.IssuedAt = time.Now().Unix()
+	claims.NotBefore = claims.IssuedAt
 	claims.ExpiresAt = expireToken.Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return claims
+}
+
+// newClaims is NewClaims with the issuer, audience and tenant of the Authenticator.
+func (a Authenticator) newClaims(expireToken time.Time, user []byte, freebie byte) Claims {
+	claims := NewClaims(expireToken, user, freebie)
+	claims.Issuer = a.Issuer
+	claims.Audience = a.Audience
+	claims.Tenant = a.tenant
+	return claims
+}
+
+func ReplyJWT(ctx context.Context, w http.ResponseWriter, keys KeySet, expireToken time.Time, user []byte, freebie byte) {
+	ReplyClaims(ctx, w, keys, NewClaims(expireToken, user, freebie))
+}
+
+// ReplyClaims signs claims and replies with access token.
+func ReplyClaims(ctx context.Context, w http.ResponseWriter, keys KeySet, claims Claims) {
+	replyToken(ctx, w, keys, claims, nil)
+}
+
+// replyToken is ReplyClaims that adds extra fields to the response, e.g. refresh_token.
+func replyToken(ctx context.Context, w http.ResponseWriter, keys KeySet, claims Claims, extra map[string]interface{}) {
+	expireToken := time.Unix(claims.ExpiresAt, 0)
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(secret))
+	// Sign and get the complete encoded token as a string using the signing key
+	tokenString, err := keys.Sign(claims)
 	if err != nil {
 		errmsg := "unable to create auth token"
 		// remember it's bad practice to expose internal errors.
@@ -159,24 +467,32 @@ func ReplyJWT(ctx context.Context, w http.ResponseWriter, secret string, expireT
 		return
 	}
 
-	scope := "all"
-	if freebie != 0 {
-		scope = "limited"
-	}
-
 	expSec := time.Since(expireToken).Seconds()
 	response := map[string]interface{}{
 		"access_token": tokenString,
 		"token_type":   "Bearer",
 		"expires_in":   -int(expSec),
-		"scope":        scope,
+		"scope":        claims.Scope,
+	}
+	if len(claims.Entitlements) > 0 {
+		response["entitlements"] = claims.Entitlements
+	}
+	if claims.Provisional {
+		response["provisional"] = true
+	}
+	for k, v := range extra {
+		response[k] = v
 	}
 
 	// add usage for log info purposes
 	ctx = usage.NewContext(ctx,
 		"uid", claims.UID,
 		"expires_in", -int(expSec),
+		"entitlements", strings.Join(claims.Entitlements, " "),
 	)
+	if claims.Provisional {
+		ctx = usage.NewContext(ctx, "provisional", true)
+	}
 	reply.Ok(ctx, w, response)
 }
 
@@ -207,7 +523,44 @@ func stringInSlice(a string, list []string) bool {
 
 // IntrospectHandler verifies access token.
 // It forbids or requests authorization if token is invalid.
-func IntrospectHandler(secret string, next NextHandlerBuilder) http.HandlerFunc {
+func IntrospectHandler(keys KeySet, next NextHandlerBuilder) http.HandlerFunc {
+	return IntrospectClaimsHandler(keys, ClaimsBuilder(next))
+}
+
+// ClaimsBuilder adapts NextHandlerBuilder to ClaimsHandlerBuilder.
+func ClaimsBuilder(next NextHandlerBuilder) ClaimsHandlerBuilder {
+	return func(claims Claims) http.Handler {
+		return next(claims.UID, claims.Freebie == 1)
+	}
+}
+
+// IntrospectClaimsHandler is IntrospectHandler that passes all the token claims to the next handler.
+// Use it with RequireScopes and RequireEntitlements to authorize the request per route.
+// The token is accepted if it's signed by any key of the set.
+func IntrospectClaimsHandler(keys KeySet, next ClaimsHandlerBuilder) http.HandlerFunc {
+	return Introspector{Keys: keys}.Handler(next)
+}
+
+// Introspector is IntrospectClaimsHandler with extended settings.
+type Introspector struct {
+	Keys KeySet
+
+	// Revocations if set, is checked on every request, so the token could be revoked before its expiration.
+	Revocations RevocationStore
+
+	// Issuer and Audience if set, the token must have exactly the same iss and aud claims.
+	Issuer   string
+	Audience string
+	// Tenant if set, the token must be issued for the app with this bundle id (tnt claim).
+	// Set it if Keys verifies the tokens of several tenants (e.g. Tenants.KeySet) or the tenants share Authenticator.Keys,
+	// otherwise the token of one app is accepted by the API of another one.
+	Tenant string
+	// Leeway is the tolerated clock skew between the token issuer and the verifier, applied to exp, nbf and iat.
+	Leeway time.Duration
+}
+
+// Handler verifies access token and passes its claims to the next handler.
+func (in Introspector) Handler(next ClaimsHandlerBuilder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -218,19 +571,14 @@ func IntrospectHandler(secret string, next NextHandlerBuilder) http.HandlerFunc
 			return
 		}
 
-		claims := Claims{}
-		keyFunc := func(token *jwt.Token) (interface{}, error) {
-			return []byte(secret), nil
-		}
-		_, err := jwt.ParseWithClaims(tokenString, &claims, keyFunc)
+		claims, errmsg, err := in.verify(ctx, tokenString)
 		if err != nil {
-			errmsg = "token expired"
-			if verr, ok := err.(*jwt.ValidationError); !ok || verr.Errors&jwt.ValidationErrorExpired == 0 {
-				errmsg = "invalid access token"
-				// log system error or hacker attack
-				log.Error(ctx, "invalid access token", "err", err, "type", "auth.invalid")
-			}
-
+			// fail closed, the token might be revoked
+			log.Error(ctx, "unable to check token revocation", "err", err, "type", "auth.revoke")
+			reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if errmsg != "" {
 			w.Header().Set("WWW-Authenticate", "Bearer")
 			reply.Err(ctx, w, http.StatusUnauthorized, errmsg)
 			return
@@ -243,10 +591,69 @@ func IntrospectHandler(secret string, next NextHandlerBuilder) http.HandlerFunc
 		ctx = usage.NewContext(ctx,
 			"uid", claims.UID,
 			"freebie", claims.Freebie,
+			"tenant", claims.Tenant,
 		)
 
-		next(claims.UID, claims.Freebie == 1).ServeHTTP(w, r.WithContext(ctx))
+		next(claims).ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// verify parses the token and checks it's not revoked.
+// The errmsg describes why the token is not valid, the err is system error.
+func (in Introspector) verify(ctx context.Context, tokenString string) (Claims, string, error) {
+	claims := Claims{}
+	// the claims are validated by Introspector itself, it's stricter than jwt-go
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	if _, err := parser.ParseWithClaims(tokenString, &claims, in.Keys.Keyfunc); err != nil {
+		// log system error or hacker attack
+		log.Error(ctx, "invalid access token", "err", err, "type", "auth.invalid")
+		return claims, "invalid access token", nil
+	}
+
+	if errmsg := in.validate(claims); errmsg != "" {
+		if errmsg != errExpired {
+			log.Error(ctx, "invalid access token", "err", errmsg, "type", "auth.invalid")
+		}
+		return claims, errmsg, nil
+	}
+
+	if in.Revocations != nil {
+		revoked, err := in.Revocations.Revoked(ctx, claims)
+		if err != nil {
+			return claims, "", err
+		}
+		if revoked {
+			return claims, "token revoked", nil
+		}
+	}
+	return claims, "", nil
+}
+
+const errExpired = "token expired"
+
+// validate checks the time claims with leeway, and issuer and audience if they are configured.
+// It returns the message saying which claim failed.
+func (in Introspector) validate(claims Claims) string {
+	now := time.Now().Unix()
+	leeway := int64(in.Leeway / time.Second)
+
+	switch {
+	case claims.ExpiresAt == 0:
+		return "invalid access token: expiration is missing (exp)"
+	case now > claims.ExpiresAt+leeway:
+		return errExpired
+	case claims.NotBefore != 0 && now+leeway < claims.NotBefore:
+		return "invalid access token: token is not valid yet (nbf)"
+	case claims.IssuedAt != 0 && now+leeway < claims.IssuedAt:
+		return "invalid access token: token is issued in the future (iat)"
+	case in.Issuer != "" && claims.Issuer != in.Issuer:
+		return fmt.Sprintf("invalid access token: unexpected issuer (iss) %q", claims.Issuer)
+	case in.Audience != "" && claims.Audience != in.Audience:
+		return fmt.Sprintf("invalid access token: unexpected audience (aud) %q", claims.Audience)
+	case in.Tenant != "" && claims.Tenant != in.Tenant:
+		return fmt.Sprintf("invalid access token: unexpected tenant (tnt) %q", claims.Tenant)
 	}
+	return ""
 }
 
 func introParams(r *http.Request) (token, errmsg string) {
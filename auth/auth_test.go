@@ -0,0 +1,454 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/iap/iaptest"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+var testKeys = HMACKeySet("test secret")
+
+func TestAuthenticatorCatalog(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour)
+	apple := appleServer(t,
+		subscription("basic.monthly", "1", future),
+		subscription("pro.monthly", "2", future.Add(-time.Hour)),
+		subscription("export.yearly", "3", future),
+	)
+	catalog := iap.Catalog{Products: []iap.Product{
+		{ID: "basic.monthly", Group: "main", Level: 1, Entitlements: []string{"read"}},
+		{ID: "pro.monthly", Group: "main", Level: 2, Entitlements: []string{"read", "pro"}},
+		{ID: "export.yearly", Group: "addons", Level: 1, Entitlements: []string{"export"}},
+	}}
+
+	a := Authenticator{
+		Keys:     testKeys,
+		Period:   48 * time.Hour,
+		Receipts: apple.ReceiptService(),
+		Catalog:  &catalog,
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, tokenRequest(t, map[string]string{}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	claims := parseToken(t, w.Body.Bytes())
+	require.Equal(t, []string{"export", "pro", "read"}, claims.Entitlements)
+	require.Equal(t, future.Add(-time.Hour).Unix(), claims.ExpiresAt)
+}
+
+func TestAuthenticatorCatalogUID(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour)
+	catalog := iap.Catalog{Products: []iap.Product{
+		{ID: "pro.monthly", Group: "main", Level: 2, Entitlements: []string{"pro"}},
+		{ID: "export.yearly", Group: "addons", Level: 1, Entitlements: []string{"export"}},
+	}}
+	uid := func(subscriptions ...iaptest.Transaction) string {
+		a := Authenticator{
+			Keys:     testKeys,
+			Period:   time.Hour,
+			Receipts: appleServer(t, subscriptions...).ReceiptService(),
+			Catalog:  &catalog,
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, tokenRequest(t, map[string]string{}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return parseToken(t, w.Body.Bytes()).UID
+	}
+
+	// the user subscribes to the add-on, its group goes first by name, but the uid stays the same
+	main := subscription("pro.monthly", "2", future)
+	addon := subscription("export.yearly", "3", future.Add(time.Hour))
+	require.Equal(t, uid(main), uid(main, addon))
+	require.Equal(t, uid(main), uid(addon, main))
+}
+
+func TestRefreshToken(t *testing.T) {
+	apple := appleServer(t, subscription("basic.monthly", "1", time.Now().Add(24*time.Hour)))
+	a := Authenticator{
+		Keys:     testKeys,
+		Period:   time.Hour,
+		Receipts: apple.ReceiptService(),
+		Refresh:  NewMemoryRefreshStore(),
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, tokenRequest(t, map[string]string{}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	first := refreshToken(t, w.Body.Bytes())
+	uid := parseToken(t, w.Body.Bytes()).UID
+
+	// rotation
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(first))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, uid, parseToken(t, w.Body.Bytes()).UID)
+	second := refreshToken(t, w.Body.Bytes())
+	require.NotEqual(t, first, second)
+
+	// reuse of rotated token revokes the family
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(first))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(second))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRefreshTokenAppleFailure(t *testing.T) {
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.SetReceipt("cmVjZWlwdA==", iaptest.Receipt{
+		Transactions: []iaptest.Transaction{
+			{ProductID: "basic.monthly", TransactionID: "1", OriginalTransactionID: "1", ExpiresDate: time.Now().Add(time.Hour)},
+		},
+	})
+	a := Authenticator{
+		Keys:     testKeys,
+		Period:   time.Hour,
+		Receipts: apple.ReceiptService(),
+		Refresh:  NewMemoryRefreshStore(),
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, tokenRequest(t, map[string]string{}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	first := refreshToken(t, w.Body.Bytes())
+
+	// the failed refresh doesn't burn the token
+	apple.Fail(iaptest.Fault{HTTPStatus: http.StatusServiceUnavailable, Count: 1})
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(first))
+	require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(first))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	second := refreshToken(t, w.Body.Bytes())
+
+	// the token is rotated after success, so the family is revoked on reuse as before
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(first))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(second))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestIntrospectorClaims(t *testing.T) {
+	ok := func(claims Claims) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	in := Introspector{Keys: testKeys, Issuer: "auth", Audience: "api", Leeway: time.Minute}
+	handler := in.Handler(ok)
+
+	valid := func() Claims {
+		claims := Authenticator{Issuer: "auth", Audience: "api"}.newClaims(time.Now().Add(time.Hour), []byte("user"), 0)
+		require.Equal(t, claims.IssuedAt, claims.NotBefore)
+		return claims
+	}
+	with := func(modify func(c *Claims)) Claims {
+		claims := valid()
+		modify(&claims)
+		return claims
+	}
+	now := time.Now()
+
+	testcases := []struct {
+		name      string
+		claims    Claims
+		expectMsg string
+	}{
+		{"valid", valid(), ""},
+		{"expired within leeway", with(func(c *Claims) { c.ExpiresAt = now.Add(-30 * time.Second).Unix() }), ""},
+		{"expired", with(func(c *Claims) { c.ExpiresAt = now.Add(-2 * time.Minute).Unix() }), "token expired"},
+		{"no exp", with(func(c *Claims) { c.ExpiresAt = 0 }), "(exp)"},
+		{"skewed nbf within leeway", with(func(c *Claims) { c.NotBefore = now.Add(30 * time.Second).Unix() }), ""},
+		{"not valid yet", with(func(c *Claims) { c.NotBefore = now.Add(2 * time.Minute).Unix() }), "(nbf)"},
+		{"issued in future", with(func(c *Claims) { c.IssuedAt = now.Add(2 * time.Minute).Unix() }), "(iat)"},
+		{"other issuer", with(func(c *Claims) { c.Issuer = "other" }), "(iss)"},
+		{"other audience", with(func(c *Claims) { c.Audience = "admin" }), "(aud)"},
+		{"no audience", with(func(c *Claims) { c.Audience = "" }), "(aud)"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, apiRequest(t, tc.claims))
+			if tc.expectMsg == "" {
+				require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+				return
+			}
+			require.Equal(t, http.StatusUnauthorized, w.Code)
+			require.Contains(t, w.Body.String(), tc.expectMsg)
+		})
+	}
+}
+
+func TestAuthenticatorAppStoreErrors(t *testing.T) {
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.SetReceipt("cmVjZWlwdA==", iaptest.Receipt{
+		Environment: iaptest.Sandbox,
+		Transactions: []iaptest.Transaction{
+			{ProductID: "basic.monthly", TransactionID: "1", OriginalTransactionID: "1", ExpiresDate: time.Now().Add(time.Hour)},
+		},
+	})
+	apple.SetReceipt("ZXhwaXJlZA==", iaptest.Receipt{
+		Transactions: []iaptest.Transaction{
+			{ProductID: "basic.monthly", TransactionID: "2", OriginalTransactionID: "2", ExpiresDate: time.Now().Add(-time.Hour)},
+		},
+	})
+
+	rs := apple.ReceiptService()
+	rs.Retry = iap.RetryPolicy{MaxRetry: 1, Backoff: time.Millisecond}
+	a := Authenticator{Keys: testKeys, Period: time.Hour, Receipts: rs}
+
+	testcases := []struct {
+		name    string
+		receipt string
+		fault   iaptest.Fault
+		expect  int
+	}{
+		{"sandbox receipt", "cmVjZWlwdA==", iaptest.Fault{}, http.StatusOK},
+		{"retried", "cmVjZWlwdA==", iaptest.Fault{Status: 21100, Count: 1}, http.StatusOK},
+		{"retries exhausted", "cmVjZWlwdA==", iaptest.Fault{Status: 21100, Count: 2}, http.StatusInternalServerError},
+		{"sandbox hiccup", "cmVjZWlwdA==", iaptest.Fault{Environment: iaptest.Sandbox, HTTPStatus: http.StatusServiceUnavailable, Count: 1}, http.StatusOK},
+		{"sandbox is down", "cmVjZWlwdA==", iaptest.Fault{Environment: iaptest.Sandbox, HTTPStatus: http.StatusServiceUnavailable}, http.StatusInternalServerError},
+		{"expired", "ZXhwaXJlZA==", iaptest.Fault{}, http.StatusForbidden},
+		{"unknown receipt", "dW5rbm93bg==", iaptest.Fault{}, http.StatusInternalServerError},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer apple.ClearFaults()
+			if tc.fault != (iaptest.Fault{}) {
+				apple.Fail(tc.fault)
+			}
+
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, tokenRequest(t, map[string]string{"receipt": tc.receipt}))
+			require.Equal(t, tc.expect, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestAuthenticatorDeviceCheck(t *testing.T) {
+	const device = "FC40A4BA-F5B2-4FC0-95E5-1179A9DE7003"
+	signer := iaptest.NewSigner()
+	valid := string(signer.Receipt("com.myfirm.myapp", device))
+	anotherApp := string(signer.Receipt("com.myfirm.other", device))
+	unknownApp := string(signer.Receipt("com.evil.app", device))
+	anotherDevice := string(signer.Receipt("com.myfirm.myapp", "6AFEB3A1-2A5B-4E8C-9D3F-2F4A1E7C0B11"))
+	foreign := string(iaptest.NewSigner().Receipt("com.myfirm.myapp", device))
+
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	paid := iaptest.NewBuilder(time.Now()).Subscribe("basic.monthly", 30*24*time.Hour, time.Hour).Receipt()
+	for _, receipt := range []string{valid, anotherApp, unknownApp, anotherDevice, foreign} {
+		apple.SetReceipt(receipt, paid)
+	}
+
+	a := Authenticator{
+		Keys:        testKeys,
+		Period:      time.Hour,
+		Receipts:    apple.ReceiptService(),
+		DeviceCheck: &iap.LocalVerifier{Roots: signer.Roots(), BundleIDs: []string{"com.myfirm.myapp", "com.myfirm.other"}},
+	}
+
+	testcases := []struct {
+		name       string
+		receipt    string
+		expectCode int
+		expectMsg  string
+	}{
+		{"valid", valid, http.StatusOK, ""},
+		{"another app", anotherApp, http.StatusForbidden, "receipt is issued for another app"},
+		{"another device", anotherDevice, http.StatusForbidden, "receipt is issued for another device"},
+		{"unknown app", unknownApp, http.StatusForbidden, "invalid receipt"},
+		{"untrusted signer", foreign, http.StatusForbidden, "invalid receipt"},
+		{"garbage", "cmVjZWlwdA==", http.StatusForbidden, "invalid receipt"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, tokenRequest(t, map[string]string{"receipt": tc.receipt}))
+			require.Equal(t, tc.expectCode, w.Code, w.Body.String())
+			require.Contains(t, w.Body.String(), tc.expectMsg)
+		})
+	}
+
+	// the rejected receipts never reach Apple
+	require.Len(t, apple.Requests(), 1)
+}
+
+func TestEntitle(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour)
+	subscriptions := []iap.AutoRenewable{
+		{InApp: iap.InApp{ProductID: "basic.monthly", OriginalTransactionID: "1", SubscriptionExpirationDate: iap.Time{Time: future}}, State: iap.ARActive},
+	}
+	verifier := iap.VerifierFunc(func(ctx context.Context, receipt []byte, filter iap.ARState) ([]iap.AutoRenewable, []byte, error) {
+		switch string(receipt) {
+		case "paid":
+			return subscriptions, []byte("latest"), nil
+		case "free":
+			return nil, receipt, nil
+		}
+		return nil, nil, errors.New("verifier is down")
+	})
+	a := Authenticator{Period: time.Hour, Receipts: verifier}
+	ctx := context.Background()
+
+	ent, err := a.Entitle(ctx, []byte("paid"), "device")
+	require.NoError(t, err)
+	require.Equal(t, subscriptionUser(subscriptions[0].InApp), ent.User)
+	require.Equal(t, []byte("latest"), ent.Receipt)
+	require.WithinDuration(t, time.Now().Add(time.Hour), ent.ExpiresAt, time.Minute)
+
+	// the token doesn't outlive the subscription
+	a.Period = 48 * time.Hour
+	ent, err = a.Entitle(ctx, []byte("paid"), "device")
+	require.NoError(t, err)
+	require.True(t, ent.ExpiresAt.Equal(future))
+
+	_, err = a.Entitle(ctx, []byte("free"), "device")
+	require.Equal(t, ErrNoSubscriptions, err)
+
+	_, err = a.Entitle(ctx, []byte("garbage"), "device")
+	require.EqualError(t, err, "verifier is down")
+}
+
+func TestRequireEntitlements(t *testing.T) {
+	ok := func(claims Claims) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	handler := IntrospectClaimsHandler(testKeys, RequireScopes(RequireEntitlements(ok, "pro", "export"), ScopeAll))
+
+	testcases := []struct {
+		name         string
+		freebie      byte
+		entitlements []string
+		expectCode   int
+	}{
+		{"all entitlements", 0, []string{"export", "pro", "read"}, http.StatusOK},
+		{"missed entitlement", 0, []string{"pro"}, http.StatusForbidden},
+		{"freebie", 1, []string{"export", "pro"}, http.StatusForbidden},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := NewClaims(time.Now().Add(time.Hour), []byte("user"), tc.freebie)
+			claims.Entitlements = tc.entitlements
+
+			w := httptest.NewRecorder()
+			handler(w, apiRequest(t, claims))
+			require.Equal(t, tc.expectCode, w.Code)
+			if tc.expectCode == http.StatusForbidden {
+				require.Contains(t, w.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+			}
+		})
+	}
+}
+
+/**************************** helpers ****************************/
+
+func apiRequest(t *testing.T, claims Claims) *http.Request {
+	token, err := testKeys.Sign(claims)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/api", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// appleServer starts fake App Store, the default receipt of tokenRequest has the subscriptions.
+func appleServer(t *testing.T, subscriptions ...iaptest.Transaction) *iaptest.Server {
+	apple := iaptest.NewServer()
+	t.Cleanup(apple.Close)
+	apple.SetReceipt("cmVjZWlwdA==", iaptest.Receipt{Transactions: subscriptions})
+	return apple
+}
+
+// subscription is the transaction of the monthly subscription expiring at the time.
+func subscription(productID, originalTransactionID string, expires time.Time) iaptest.Transaction {
+	return iaptest.Transaction{
+		ProductID:             productID,
+		TransactionID:         originalTransactionID,
+		OriginalTransactionID: originalTransactionID,
+		PurchaseDate:          expires.Add(-30 * 24 * time.Hour),
+		OriginalPurchaseDate:  expires.Add(-30 * 24 * time.Hour),
+		ExpiresDate:           expires,
+	}
+}
+
+// tokenRequest makes multipart request to AuthenticationHandler, params override the defaults.
+func tokenRequest(t *testing.T, params map[string]string) *http.Request {
+	values := map[string]string{
+		"bundle_id":             "com.myfirm.myapp",
+		"identifier_for_vendor": "FC40A4BA-F5B2-4FC0-95E5-1179A9DE7003",
+		"receipt":               "cmVjZWlwdA==",
+	}
+	for k, v := range params {
+		values[k] = v
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for k, v := range values {
+		if k == "receipt" {
+			fw, err := mw.CreateFormFile(k, "receipt.bin")
+			require.NoError(t, err)
+			fw.Write([]byte(v))
+			continue
+		}
+		require.NoError(t, mw.WriteField(k, v))
+	}
+	require.NoError(t, mw.Close())
+
+	r := httptest.NewRequest("POST", "/token", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func refreshRequest(token string) *http.Request {
+	form := url.Values{"grant_type": {GrantRefreshToken}, "refresh_token": {token}}
+	r := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func refreshToken(t *testing.T, body []byte) string {
+	resp := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(body, &resp))
+	token, _ := resp["refresh_token"].(string)
+	require.NotEmpty(t, token)
+	return token
+}
+
+func parseToken(t *testing.T, body []byte) Claims {
+	resp := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(bytes.NewReader(body)).Decode(&resp))
+
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(resp["access_token"].(string), &claims, testKeys.Keyfunc)
+	require.NoError(t, err)
+	return claims
+}
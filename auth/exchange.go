@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"sync"
+
+	"github.com/Loofort/ios-back/log"
+	"github.com/Loofort/ios-back/reply"
+)
+
+const (
+	// GrantTokenExchange is the grant_type of the request upgrading limited token to the full one, see https://tools.ietf.org/html/rfc8693
+	// Besides the usual parameters and the receipt, the request has subject_token - the limited access token.
+	// It's supported only with Authenticator.DeviceCheck: the limited token is bound to identifier_for_vendor,
+	// which is not a secret, so the receipt must prove it's issued for that device.
+	GrantTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// TokenTypeAccessToken is the only supported subject_token_type.
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// AliasStore keeps the former user ids.
+// The data created by the user during free period is bound to the uid of limited token,
+// use the alias to find it after the user has paid.
+type AliasStore interface {
+	// AddAlias records the alias of the user.
+	AddAlias(ctx context.Context, uid, alias string) error
+	// Aliases returns all the aliases of the user.
+	Aliases(ctx context.Context, uid string) ([]string, error)
+}
+
+// exchangeSubject verifies the subject_token is the limited token issued for the device, and returns its uid.
+// It replies with error itself and returns false if the token can't be exchanged.
+func (a Authenticator) exchangeSubject(ctx context.Context, w http.ResponseWriter, r *http.Request, idForVendor string) (string, bool) {
+	if a.DeviceCheck == nil {
+		reply.Err(ctx, w, http.StatusBadRequest, "unsupported grant_type")
+		return "", false
+	}
+
+	subject := r.FormValue("subject_token")
+	if subject == "" {
+		reply.Err(ctx, w, http.StatusBadRequest, "please provide subject_token")
+		return "", false
+	}
+	if typ := r.FormValue("subject_token_type"); typ != "" && typ != TokenTypeAccessToken {
+		reply.Err(ctx, w, http.StatusBadRequest, "unsupported subject_token_type")
+		return "", false
+	}
+
+	in := Introspector{Keys: a.Keys, Issuer: a.Issuer, Audience: a.Audience}
+	claims, errmsg, err := in.verify(ctx, subject)
+	if err != nil {
+		log.Error(ctx, "unable to verify subject token", "err", err, "type", "auth.exchange")
+		reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return "", false
+	}
+	if errmsg != "" {
+		reply.Err(ctx, w, http.StatusBadRequest, "invalid subject_token: "+errmsg)
+		return "", false
+	}
+
+	switch {
+	case !claims.HasScope(ScopeLimited):
+		reply.Err(ctx, w, http.StatusBadRequest, "invalid subject_token: only limited token could be exchanged")
+		return "", false
+	case claims.Tenant != a.tenant:
+		reply.Err(ctx, w, http.StatusBadRequest, "invalid subject_token: token is issued for another app")
+		return "", false
+	case claims.UID != base64.RawStdEncoding.EncodeToString([]byte(idForVendor)):
+		// the limited token is keyed by identifier_for_vendor, see Authenticator.ServeHTTP
+		reply.Err(ctx, w, http.StatusBadRequest, "invalid subject_token: token is issued for another device")
+		return "", false
+	}
+	return claims.UID, true
+}
+
+// MemoryAliasStore is in-memory AliasStore.
+// The aliases are lost on restart, so the data of the free period can't be found for the users exchanged before it,
+// and they are not shared between instances. The aliases never expire, the store grows with every exchange.
+type MemoryAliasStore struct {
+	mu      sync.Mutex
+	aliases map[string][]string
+}
+
+func NewMemoryAliasStore() *MemoryAliasStore {
+	return &MemoryAliasStore{aliases: map[string][]string{}}
+}
+
+func (s *MemoryAliasStore) AddAlias(ctx context.Context, uid, alias string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !stringInSlice(alias, s.aliases[uid]) {
+		s.aliases[uid] = append(s.aliases[uid], alias)
+	}
+	return nil
+}
+
+func (s *MemoryAliasStore) Aliases(ctx context.Context, uid string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.aliases[uid]...), nil
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/iap/iaptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenExchange(t *testing.T) {
+	apple := appleServer(t)
+	aliases := NewMemoryAliasStore()
+	signer := iaptest.NewSigner()
+	a := Authenticator{
+		Keys:        testKeys,
+		Period:      time.Hour,
+		Receipts:    apple.ReceiptService(),
+		Aliases:     aliases,
+		DeviceCheck: &iap.LocalVerifier{Roots: signer.Roots(), BundleIDs: []string{"com.myfirm.myapp"}},
+	}
+	receipt := string(signer.Receipt("com.myfirm.myapp", "FC40A4BA-F5B2-4FC0-95E5-1179A9DE7003"))
+	apple.SetReceipt(receipt, iaptest.Receipt{Transactions: []iaptest.Transaction{subscription("basic.monthly", "1", time.Now().Add(24*time.Hour))}})
+
+	token := func(params map[string]string) (int, []byte, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, tokenRequest(t, params))
+		resp := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return w.Code, w.Body.Bytes(), resp
+	}
+
+	code, body, resp := token(map[string]string{"scope": ScopeLimited})
+	require.Equal(t, http.StatusOK, code, resp)
+	limited := resp["access_token"].(string)
+	limitedUID := parseToken(t, body).UID
+
+	code, body, resp = token(map[string]string{"grant_type": GrantTokenExchange, "subject_token": limited, "subject_token_type": TokenTypeAccessToken, "receipt": receipt})
+	require.Equal(t, http.StatusOK, code, resp)
+	full := parseToken(t, body)
+	require.Equal(t, ScopeAll, full.Scope)
+	require.Equal(t, TokenTypeAccessToken, resp["issued_token_type"])
+	require.NotEqual(t, limitedUID, full.UID)
+
+	got, err := aliases.Aliases(context.Background(), full.UID)
+	require.NoError(t, err)
+	require.Equal(t, []string{limitedUID}, got)
+
+	testcases := []struct {
+		name      string
+		params    map[string]string
+		expectMsg string
+	}{
+		{"no subject", map[string]string{}, "subject_token"},
+		{"full token", map[string]string{"subject_token": resp["access_token"].(string)}, "only limited token"},
+		{"another device", map[string]string{"subject_token": limited, "identifier_for_vendor": "another"}, "another device"},
+		{"unsupported type", map[string]string{"subject_token": limited, "subject_token_type": "urn:ietf:params:oauth:token-type:id_token"}, "subject_token_type"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.params["grant_type"] = GrantTokenExchange
+			tc.params["receipt"] = receipt
+			code, _, resp := token(tc.params)
+			require.Equal(t, http.StatusBadRequest, code, resp)
+			require.Contains(t, resp["message"], tc.expectMsg)
+		})
+	}
+
+	// the receipt of another device
+	another := string(signer.Receipt("com.myfirm.myapp", "6AFEB3A1-2A5B-4E8C-9D3F-2F4A1E7C0B11"))
+	code, _, resp = token(map[string]string{"grant_type": GrantTokenExchange, "subject_token": limited, "receipt": another})
+	require.Equal(t, http.StatusForbidden, code, resp)
+
+	// the device can't be proved without DeviceCheck
+	a.DeviceCheck = nil
+	code, _, resp = token(map[string]string{"grant_type": GrantTokenExchange, "subject_token": limited, "receipt": receipt})
+	require.Equal(t, http.StatusBadRequest, code, resp)
+	require.Contains(t, resp["message"], "unsupported grant_type")
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Loofort/ios-back/iap"
+)
+
+// Identity derives the user id (uid claim) of the entitled user.
+type Identity interface {
+	// UID returns the user id, the subscriptions are the chosen ones (the best first, at least one),
+	// the device is identifier_for_vendor verified by Authenticator.DeviceCheck, empty if it's not verified.
+	UID(ctx context.Context, device string, subscriptions []iap.AutoRenewable) ([]byte, error)
+}
+
+// TransactionIdentity derives user id from the first subscription: sha224(OriginalTransactionID + OriginalPurchaseDate).
+// It needs no storage, but has uncertainty:
+//  1. OriginalTransactionID may not be unique if user has canceled purchase. That's why OriginalPurchaseDate is added.
+//  2. OriginalTransactionID may not be unique across multiple devices (or even behave like identifierForVendor).
+//
+// Use AccountIdentity to keep the same user id across devices and re-purchases.
+type TransactionIdentity struct{}
+
+func (TransactionIdentity) UID(ctx context.Context, device string, subscriptions []iap.AutoRenewable) ([]byte, error) {
+	return subscriptionUser(subscriptions[0].InApp), nil
+}
+
+func subscriptionUser(sbs iap.InApp) []byte {
+	user := sha256.Sum224([]byte(sbs.OriginalTransactionID + sbs.OriginalPurchaseDate.String()))
+	return user[:]
+}
+
+// AccountIdentity links subscription identifiers to the stable account id, the account id is the user id.
+// The user keeps the same uid on all the devices and after restore or renewal,
+// as long as any of the subscription identifiers (or Apple user id) was seen before.
+// The verified device is linked to the account too, but it never identifies the user:
+// identifier_for_vendor is not a secret, so the device of another user must not give access to the account.
+// The accounts are never merged, the identifier linked to one account stays with it.
+// The account is owned by one Apple user at most, see signInWithApple.
+// Note SubscriptionUID doesn't work with it, set Authenticator.Revocations to revoke the tokens by the account id.
+type AccountIdentity struct {
+	Store AccountStore
+}
+
+// ErrAccountOwned is returned by AccountStore.Link if the account found by the keys has another owner.
+var ErrAccountOwned = errors.New("account is owned by another user")
+
+// AccountStore keeps links of identifiers to accounts.
+type AccountStore interface {
+	// Link returns the account of the first known key, or the new account if no key is known.
+	// It links the keys and the attached keys to the account, except the ones already linked to another account.
+	// The attached keys are never used to find the account.
+	// The owner key (if not empty) is looked up before the keys, but the account has one owner at most:
+	// if the owner is unknown and the account found by the keys has an owner, it returns ErrAccountOwned and links nothing.
+	// It must be atomic.
+	Link(ctx context.Context, owner string, keys, attached []string) (account string, err error)
+}
+
+func (ai AccountIdentity) UID(ctx context.Context, device string, subscriptions []iap.AutoRenewable) ([]byte, error) {
+	return ai.link(ctx, "", device, subscriptions)
+}
+
+// link links the owner and the keys of subscriptions and device to the account, see AccountStore.Link.
+func (ai AccountIdentity) link(ctx context.Context, owner string, device string, subscriptions []iap.AutoRenewable) ([]byte, error) {
+	// the order sets priority: transactions identify the Apple ID, the device may be shared by family
+	var keys []string
+	for _, sbs := range subscriptions {
+		keys = append(keys, "otid:"+sbs.OriginalTransactionID)
+		if sbs.WebOrderLineItemID != "" {
+			keys = append(keys, "woli:"+sbs.WebOrderLineItemID)
+		}
+	}
+	var attached []string
+	if device != "" {
+		attached = append(attached, "device:"+device)
+	}
+
+	account, err := ai.Store.Link(ctx, owner, keys, attached)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(account), nil
+}
+
+// FileAccountStore is AccountStore kept in memory and saved to json file on every change.
+// It suits single instance deployment, use database for anything bigger.
+type FileAccountStore struct {
+	path string
+
+	mu    sync.Mutex
+	links map[string]string // key -> account
+}
+
+// NewFileAccountStore loads the links from the file, if it exists.
+// The empty path means the links are kept in memory only.
+func NewFileAccountStore(path string) (*FileAccountStore, error) {
+	s := &FileAccountStore{path: path, links: map[string]string{}}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(data, &s.links)
+}
+
+func (s *FileAccountStore) Link(ctx context.Context, owner string, keys, attached []string) (string, error) {
+	if owner == "" && len(keys) == 0 {
+		return "", errors.New("no keys to link")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account := ""
+	if owner != "" {
+		account = s.links[owner]
+	}
+	if account == "" {
+		for _, key := range keys {
+			if account = s.links[key]; account != "" {
+				break
+			}
+		}
+		if account != "" && owner != "" && s.links[ownedKey(account)] != "" {
+			return "", ErrAccountOwned
+		}
+	}
+	if account == "" {
+		account = newTokenID()
+	}
+
+	linking := append([]string(nil), keys...)
+	if owner != "" {
+		// the account is marked as owned by the link of its own, so the file keeps key -> account format
+		linking = append(linking, owner, ownedKey(account))
+	}
+
+	changed := false
+	for _, key := range append(linking, attached...) {
+		if s.links[key] == "" {
+			s.links[key] = account
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := s.save(); err != nil {
+			return "", err
+		}
+	}
+	return account, nil
+}
+
+func ownedKey(account string) string {
+	return "owned:" + account
+}
+
+// save writes the file atomically, the caller holds the lock.
+func (s *FileAccountStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.links)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
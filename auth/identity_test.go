@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountIdentity(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, err := NewFileAccountStore(path)
+	require.NoError(t, err)
+	identity := AccountIdentity{Store: store}
+
+	sbs := func(otid, woli string) []iap.AutoRenewable {
+		return []iap.AutoRenewable{{InApp: iap.InApp{OriginalTransactionID: otid, WebOrderLineItemID: woli}}}
+	}
+
+	iphone, err := identity.UID(ctx, "iphone", sbs("1", "100"))
+	require.NoError(t, err)
+
+	// the same subscription on another device
+	ipad, err := identity.UID(ctx, "ipad", sbs("1", "101"))
+	require.NoError(t, err)
+	require.Equal(t, iphone, ipad)
+
+	// renewal on another device
+	renewal, err := identity.UID(ctx, "ipad", sbs("1", "102"))
+	require.NoError(t, err)
+	require.Equal(t, iphone, renewal)
+
+	// another user on the same device: the device doesn't pick the account for unknown subscription
+	other, err := identity.UID(ctx, "ipad", sbs("2", "200"))
+	require.NoError(t, err)
+	require.NotEqual(t, iphone, other)
+
+	// the receipt with subscriptions of two accounts doesn't merge them, the first known wins
+	both := append(sbs("2", "201"), sbs("1", "103")...)
+	merged, err := identity.UID(ctx, "ipad", both)
+	require.NoError(t, err)
+	require.Equal(t, other, merged)
+	first, err := identity.UID(ctx, "iphone", sbs("1", "104"))
+	require.NoError(t, err)
+	require.Equal(t, iphone, first)
+
+	// the links survive restart
+	store, err = NewFileAccountStore(path)
+	require.NoError(t, err)
+	restored, err := AccountIdentity{Store: store}.UID(ctx, "new-iphone", sbs("2", "202"))
+	require.NoError(t, err)
+	require.Equal(t, other, restored)
+
+	// the account has one owner at most, another one can't take it over by the receipt
+	identity = AccountIdentity{Store: store}
+	owned, err := identity.link(ctx, "apple:001234", "", sbs("2", "203"))
+	require.NoError(t, err)
+	require.Equal(t, other, owned)
+	_, err = identity.link(ctx, "apple:005678", "new-iphone", sbs("2", "204"))
+	require.Equal(t, ErrAccountOwned, err)
+	require.NotContains(t, store.links, "apple:005678")
+	require.NotContains(t, store.links, "woli:204")
+
+	// the owner finds the account without receipt after restart
+	store, err = NewFileAccountStore(path)
+	require.NoError(t, err)
+	identity = AccountIdentity{Store: store}
+	owned, err = identity.link(ctx, "apple:001234", "", nil)
+	require.NoError(t, err)
+	require.Equal(t, other, owned)
+	_, err = identity.link(ctx, "apple:005678", "", sbs("2", "205"))
+	require.Equal(t, ErrAccountOwned, err)
+
+	// the owner's own account wins over the subscriptions of another one
+	mine, err := identity.link(ctx, "apple:001234", "", sbs("1", "105"))
+	require.NoError(t, err)
+	require.Equal(t, other, mine)
+}
+
+func TestAccountIdentityDevice(t *testing.T) {
+	apple := appleServer(t, subscription("basic.monthly", "1", time.Now().Add(time.Hour)))
+	store, err := NewFileAccountStore("")
+	require.NoError(t, err)
+	a := Authenticator{Keys: testKeys, Period: time.Hour, Receipts: apple.ReceiptService(), Identity: AccountIdentity{Store: store}}
+
+	_, err = a.Entitle(context.Background(), []byte("cmVjZWlwdA=="), "FC40A4BA-F5B2-4FC0-95E5-1179A9DE7003")
+	require.NoError(t, err)
+	// the device isn't verified without DeviceCheck, so it's not linked
+	require.NotContains(t, store.links, "device:FC40A4BA-F5B2-4FC0-95E5-1179A9DE7003")
+	require.Contains(t, store.links, "otid:1")
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/Loofort/ios-back/log"
+	"github.com/Loofort/ios-back/reply"
+	"github.com/Loofort/ios-back/usage"
+)
+
+// IntrospectionHandler implements token introspection endpoint, see https://tools.ietf.org/html/rfc7662
+// It lets other services check the token without linking this package.
+// The callers authenticate with HTTP Basic client credentials, clients maps client_id to client_secret.
+// The clients with empty secret are ignored.
+func (in Introspector) IntrospectionHandler(clients map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		clientID, clientSecret, ok := r.BasicAuth()
+		secret := clients[clientID]
+		if !ok || secret == "" || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+			reply.Err(ctx, w, http.StatusUnauthorized, "invalid client credentials")
+			return
+		}
+		ctx = usage.NewContext(ctx, "client_id", clientID)
+
+		if r.Method != http.MethodPost {
+			reply.Err(ctx, w, http.StatusMethodNotAllowed, "use POST method")
+			return
+		}
+
+		token := r.PostFormValue("token")
+		if token == "" {
+			reply.Err(ctx, w, http.StatusBadRequest, "please provide token")
+			return
+		}
+
+		claims, errmsg, err := in.verify(ctx, token)
+		if err != nil {
+			log.Error(ctx, "unable to check token revocation", "err", err, "type", "auth.revoke")
+			reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if errmsg != "" {
+			// the reason must not be disclosed, the token is just not active
+			ctx = usage.NewContext(ctx, "inactive", errmsg)
+			reply.Ok(ctx, w, map[string]interface{}{"active": false})
+			return
+		}
+
+		ctx = usage.NewContext(ctx, "uid", claims.UID)
+		reply.Ok(ctx, w, introspection(claims))
+	}
+}
+
+// introspection is the response of active token, it includes our custom claims.
+func introspection(claims Claims) map[string]interface{} {
+	response := map[string]interface{}{
+		"active":     true,
+		"token_type": "Bearer",
+		"scope":      claims.scopes(),
+		"sub":        claims.UID,
+		"exp":        claims.ExpiresAt,
+		"frb":        claims.Freebie,
+	}
+	if claims.IssuedAt != 0 {
+		response["iat"] = claims.IssuedAt
+	}
+	if claims.Id != "" {
+		response["jti"] = claims.Id
+	}
+	if len(claims.Entitlements) > 0 {
+		response["ent"] = claims.Entitlements
+	}
+	if claims.Tenant != "" {
+		response["tnt"] = claims.Tenant
+	}
+	if claims.Provisional {
+		response["prv"] = true
+	}
+	return response
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntrospectionHandler(t *testing.T) {
+	handler := Introspector{Keys: testKeys}.IntrospectionHandler(map[string]string{
+		"billing": "billing secret",
+		"nobody":  "",
+	})
+
+	claims := NewClaims(time.Now().Add(time.Hour), []byte("user"), 0)
+	claims.Entitlements = []string{"pro"}
+	active, err := testKeys.Sign(claims)
+	require.NoError(t, err)
+
+	expired, err := testKeys.Sign(NewClaims(time.Now().Add(-time.Hour), []byte("user"), 0))
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name         string
+		client       string
+		secret       string
+		token        string
+		expectCode   int
+		expectActive bool
+	}{
+		{"active", "billing", "billing secret", active, http.StatusOK, true},
+		{"expired", "billing", "billing secret", expired, http.StatusOK, false},
+		{"garbage", "billing", "billing secret", "garbage", http.StatusOK, false},
+		{"wrong secret", "billing", "secret", active, http.StatusUnauthorized, false},
+		{"empty secret", "nobody", "", active, http.StatusUnauthorized, false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{"token": {tc.token}, "token_type_hint": {"access_token"}}
+			r := httptest.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(tc.client, tc.secret)
+
+			w := httptest.NewRecorder()
+			handler(w, r)
+			require.Equal(t, tc.expectCode, w.Code, w.Body.String())
+			if tc.expectCode != http.StatusOK {
+				return
+			}
+
+			resp := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			require.Equal(t, tc.expectActive, resp["active"])
+			if !tc.expectActive {
+				require.Len(t, resp, 1)
+				return
+			}
+			require.Equal(t, claims.UID, resp["sub"])
+			require.Equal(t, ScopeAll, resp["scope"])
+			require.Equal(t, float64(claims.ExpiresAt), resp["exp"])
+			require.Equal(t, float64(0), resp["frb"])
+			require.Equal(t, []interface{}{"pro"}, resp["ent"])
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/Loofort/ios-back/reply"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key is the key tokens are signed or verified with.
+type Key struct {
+	ID     string            // kid header, must be unique within KeySet
+	Method jwt.SigningMethod // RS256, ES256, EdDSA or HS256 (legacy shared secret)
+	// Private is *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey or []byte secret.
+	// It's nil for verification only key.
+	Private interface{}
+	// Public is *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte secret.
+	Public interface{}
+}
+
+// NewRSAKey makes RS256 key.
+func NewRSAKey(kid string, key *rsa.PrivateKey) Key {
+	return Key{ID: kid, Method: jwt.SigningMethodRS256, Private: key, Public: &key.PublicKey}
+}
+
+// NewECDSAKey makes ES256 key, the key must be on P-256 curve.
+func NewECDSAKey(kid string, key *ecdsa.PrivateKey) Key {
+	return Key{ID: kid, Method: jwt.SigningMethodES256, Private: key, Public: &key.PublicKey}
+}
+
+// NewEd25519Key makes EdDSA key.
+func NewEd25519Key(kid string, key ed25519.PrivateKey) Key {
+	return Key{ID: kid, Method: SigningMethodEdDSA, Private: key, Public: key.Public()}
+}
+
+// NewHMACKey makes HS256 key of shared secret.
+// The downstream services have to hold the secret to verify tokens, prefer asymmetric keys.
+func NewHMACKey(kid string, secret string) Key {
+	return Key{ID: kid, Method: jwt.SigningMethodHS256, Private: []byte(secret), Public: []byte(secret)}
+}
+
+// NewPublicKey makes verification only key, e.g. the public part of the former signing key.
+func NewPublicKey(kid string, pub interface{}) (Key, error) {
+	key := Key{ID: kid, Public: pub}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return key, fmt.Errorf("unsupported ecdsa curve: %s", pub.Curve.Params().Name)
+		}
+		key.Method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		key.Method = SigningMethodEdDSA
+	default:
+		return key, fmt.Errorf("unsupported public key: %T", pub)
+	}
+	return key, nil
+}
+
+// KeySet is the keys of the token issuer.
+// To rotate the key make the new one Signing and move the old one to Previous,
+// keep it there until the tokens it signed are expired.
+type KeySet struct {
+	Signing  Key   // tokens are signed with this key
+	Previous []Key // keys that are still accepted for verification
+}
+
+// HMACKeySet is the key set of single shared secret, as it was before key sets were introduced.
+// The key has no id, so tokens issued earlier (without kid header) are still valid.
+func HMACKeySet(secret string) KeySet {
+	return KeySet{Signing: NewHMACKey("", secret)}
+}
+
+// Sign makes signed token with the signing key.
+func (ks KeySet) Sign(claims jwt.Claims) (string, error) {
+	if ks.Signing.Method == nil || ks.Signing.Private == nil {
+		return "", errors.New("signing key is not configured")
+	}
+
+	token := jwt.NewWithClaims(ks.Signing.Method, claims)
+	if ks.Signing.ID != "" {
+		token.Header["kid"] = ks.Signing.ID
+	}
+	return token.SignedString(ks.Signing.Private)
+}
+
+// Keyfunc finds the verification key by kid header, it's used by jwt.Parse.
+// The token algorithm must match the key one, it prevents algorithm substitution.
+func (ks KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	for _, key := range append([]Key{ks.Signing}, ks.Previous...) {
+		if key.ID != kid || key.Method == nil {
+			continue
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+		}
+		return key.Public, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// JWK is JSON Web Key, see https://tools.ietf.org/html/rfc7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS returns public keys of the set, shared secrets are never published.
+func (ks KeySet) JWKS() []JWK {
+	jwks := []JWK{}
+	for _, key := range append([]Key{ks.Signing}, ks.Previous...) {
+		if jwk, ok := key.JWK(); ok {
+			jwks = append(jwks, jwk)
+		}
+	}
+	return jwks
+}
+
+// JWK returns public key in JWK format, false if the key is not asymmetric.
+func (k Key) JWK() (JWK, bool) {
+	enc := base64.RawURLEncoding
+	jwk := JWK{Kid: k.ID, Use: "sig"}
+	if k.Method != nil {
+		jwk.Alg = k.Method.Alg()
+	}
+
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = enc.EncodeToString(pub.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = enc.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = enc.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = enc.EncodeToString(pub)
+	default:
+		return jwk, false
+	}
+	return jwk, true
+}
+
+// JWKSHandler publishes the public keys, so other services could verify tokens without the shared secret.
+// Usually it's served at /.well-known/jwks.json
+func JWKSHandler(keys KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// the keys change rarely, but let the clients pick up the rotated key in reasonable time.
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		reply.Ok(r.Context(), w, map[string]interface{}{"keys": keys.JWKS()})
+	}
+}
+
+// SigningMethodEdDSA implements EdDSA (Ed25519) signing method, jwt-go doesn't support it.
+var SigningMethodEdDSA jwt.SigningMethod = signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+func (signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
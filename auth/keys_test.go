@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySetRotation(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	claims := NewClaims(time.Now().Add(time.Hour), []byte("user"), 0)
+
+	old := KeySet{Signing: NewECDSAKey("ec-1", ecKey)}
+	oldToken, err := old.Sign(claims)
+	require.NoError(t, err)
+
+	// rotation: the old key is still accepted, but only the public part is kept
+	oldPub, err := NewPublicKey("ec-1", &ecKey.PublicKey)
+	require.NoError(t, err)
+	rotated := KeySet{
+		Signing:  NewEd25519Key("ed-2", edKey),
+		Previous: []Key{oldPub, NewRSAKey("rsa-0", rsaKey)},
+	}
+	newToken, err := rotated.Sign(claims)
+	require.NoError(t, err)
+
+	// forged: the kid of asymmetric key, but HMAC signed with its public key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = "ed-2"
+	forgedToken, err := forged.SignedString([]byte(edKey.Public().(ed25519.PublicKey)))
+	require.NoError(t, err)
+
+	ok := func(claims Claims) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	handler := IntrospectClaimsHandler(rotated, ok)
+
+	testcases := []struct {
+		name       string
+		token      string
+		expectCode int
+	}{
+		{"new key", newToken, http.StatusOK},
+		{"previous key", oldToken, http.StatusOK},
+		{"unknown key", mustSign(t, HMACKeySet("other"), claims), http.StatusUnauthorized},
+		{"algorithm substitution", forgedToken, http.StatusUnauthorized},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api", nil)
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+			w := httptest.NewRecorder()
+			handler(w, r)
+			require.Equal(t, tc.expectCode, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keys := KeySet{
+		Signing:  NewEd25519Key("ed-2", edKey),
+		Previous: []Key{NewECDSAKey("ec-1", ecKey), NewHMACKey("legacy", "secret")},
+	}
+
+	w := httptest.NewRecorder()
+	JWKSHandler(keys)(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+
+	// shared secret must not be published
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, JWK{Kty: "OKP", Kid: "ed-2", Use: "sig", Alg: "EdDSA", Crv: "Ed25519", X: jwt.EncodeSegment(edKey.Public().(ed25519.PublicKey))}, jwks.Keys[0])
+	require.Equal(t, "EC", jwks.Keys[1].Kty)
+	require.Equal(t, "P-256", jwks.Keys[1].Crv)
+	require.Equal(t, "ES256", jwks.Keys[1].Alg)
+}
+
+func mustSign(t *testing.T, keys KeySet, claims Claims) string {
+	token, err := keys.Sign(claims)
+	require.NoError(t, err)
+	return token
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/Loofort/ios-back/log"
+)
+
+const (
+	defaultProvisionalPeriod = 10 * time.Minute
+	// memory cache removes outdated entitlements not more often than this
+	entitlementCleanupInterval = time.Minute
+)
+
+// EntitlementCache keeps the last known good entitlement by receipt hash (sha256 hex of the posted receipt).
+type EntitlementCache interface {
+	Save(ctx context.Context, receiptHash string, ent Entitlement) error
+	// Load returns false if there is no entitlement for the receipt.
+	Load(ctx context.Context, receiptHash string) (Entitlement, bool, error)
+	// Invalidate removes the entitlements with the subscription, e.g. it's refunded.
+	Invalidate(ctx context.Context, originalTransactionID string) error
+}
+
+// ReceiptHash returns the key of the receipt in EntitlementCache.
+func ReceiptHash(receipt []byte) string {
+	sum := sha256.Sum256(receipt)
+	return hex.EncodeToString(sum[:])
+}
+
+// remember saves the entitlement to the Fallback cache, failure doesn't affect the token.
+// It's saved by the posted receipt and by the latest one Apple returned,
+// the refresh token keeps the latest receipt (see RefreshToken.Receipt) and it's looked up on refresh.
+func (a Authenticator) remember(ctx context.Context, receipt []byte, ent Entitlement) {
+	if a.Fallback == nil {
+		return
+	}
+
+	receipts := [][]byte{receipt}
+	if len(ent.Receipt) > 0 && !bytes.Equal(ent.Receipt, receipt) {
+		receipts = append(receipts, ent.Receipt)
+	}
+	for _, r := range receipts {
+		if err := a.Fallback.Save(ctx, ReceiptHash(r), ent); err != nil {
+			log.Error(ctx, "unable to save entitlement", "err", err, "type", "auth.provisional")
+		}
+	}
+}
+
+// provisional returns the last known entitlement of the receipt for the short period,
+// but no more than the known subscriptions last.
+// The cause is returned if the receipt is unknown or its subscriptions have expired.
+func (a Authenticator) provisional(ctx context.Context, receipt []byte, cause error) (Entitlement, error) {
+	hash := ReceiptHash(receipt)
+	ent, ok, err := a.Fallback.Load(ctx, hash)
+	if err != nil {
+		return ent, err
+	}
+	if !ok {
+		return ent, cause
+	}
+
+	// the token expiration is no more than the earliest of chosen subscriptions, see Entitle
+	var expireSubscription time.Time
+	for _, sbs := range ent.Subscriptions {
+		if until := sbs.EntitledUntil(); expireSubscription.IsZero() || until.Before(expireSubscription) {
+			expireSubscription = until
+		}
+	}
+	if !expireSubscription.After(time.Now()) {
+		return ent, cause
+	}
+
+	period := a.ProvisionalPeriod
+	if period == 0 {
+		period = defaultProvisionalPeriod
+	}
+	if a.Period < period {
+		period = a.Period
+	}
+	ent.ExpiresAt = time.Now().Add(period)
+	if ent.ExpiresAt.After(expireSubscription) {
+		ent.ExpiresAt = expireSubscription
+	}
+	ent.Provisional = true
+	if err := a.addSubscribers(ctx, ent); err != nil {
+		return ent, err
+	}
+
+	log.Info(ctx, "provisional entitlement", "receipt_hash", hash, "err", cause, "type", "auth.provisional")
+	return ent, nil
+}
+
+// MemoryEntitlementCache is in-memory EntitlementCache.
+// The entitlements are lost on restart, so no provisional tokens are issued if Apple is down at start,
+// and they are not shared between instances, each one falls back only for the receipts it has verified.
+// The entitlements older than ttl are not loaded, and removed once a minute on Save.
+type MemoryEntitlementCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	items     map[string]cachedEntitlement
+	cleanedAt time.Time
+}
+
+type cachedEntitlement struct {
+	ent     Entitlement
+	savedAt time.Time
+}
+
+// NewMemoryEntitlementCache makes the cache, the entitlement is kept for ttl,
+// so the user doesn't get provisional tokens from too old data.
+func NewMemoryEntitlementCache(ttl time.Duration) *MemoryEntitlementCache {
+	return &MemoryEntitlementCache{ttl: ttl, items: map[string]cachedEntitlement{}}
+}
+
+func (c *MemoryEntitlementCache) Save(ctx context.Context, receiptHash string, ent Entitlement) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.cleanedAt) > entitlementCleanupInterval {
+		c.cleanup()
+	}
+	c.items[receiptHash] = cachedEntitlement{ent: ent, savedAt: time.Now()}
+	return nil
+}
+
+func (c *MemoryEntitlementCache) Load(ctx context.Context, receiptHash string) (Entitlement, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[receiptHash]
+	if !ok || time.Since(item.savedAt) > c.ttl {
+		return Entitlement{}, false, nil
+	}
+	return item.ent, true, nil
+}
+
+func (c *MemoryEntitlementCache) Invalidate(ctx context.Context, originalTransactionID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for hash, item := range c.items {
+		for _, sbs := range item.ent.Subscriptions {
+			if sbs.OriginalTransactionID == originalTransactionID {
+				delete(c.items, hash)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// cleanup removes outdated entitlements, the caller holds the lock.
+// It scans all the items, so it's called once in entitlementCleanupInterval.
+func (c *MemoryEntitlementCache) cleanup() {
+	c.cleanedAt = time.Now()
+	for hash, item := range c.items {
+		if time.Since(item.savedAt) > c.ttl {
+			delete(c.items, hash)
+		}
+	}
+}
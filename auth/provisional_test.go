@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/iap/iaptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionalToken(t *testing.T) {
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.SetReceipt("cmVjZWlwdA==", iaptest.NewBuilder(time.Now()).Subscribe("basic.monthly", 30*24*time.Hour, time.Hour).Receipt())
+	apple.SetReceipt("b3RoZXI=", iaptest.NewBuilder(time.Now()).Subscribe("basic.monthly", 30*24*time.Hour, time.Hour).Receipt())
+
+	rs := apple.ReceiptService()
+	rs.NoSandbox = true
+	rs.Breaker = &iap.CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	a := Authenticator{
+		Keys:     testKeys,
+		Period:   time.Hour,
+		Receipts: rs,
+		Fallback: NewMemoryEntitlementCache(24 * time.Hour),
+	}
+	token := func(receipt string) (int, []byte) {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, tokenRequest(t, map[string]string{"receipt": receipt}))
+		return w.Code, w.Body.Bytes()
+	}
+
+	code, body := token("cmVjZWlwdA==")
+	require.Equal(t, http.StatusOK, code, string(body))
+	good := parseToken(t, body)
+	require.False(t, good.Provisional)
+
+	// apple goes down, the failure opens the circuit
+	apple.Fail(iaptest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+	code, body = token("cmVjZWlwdA==")
+	require.Equal(t, http.StatusInternalServerError, code, string(body))
+
+	// the known receipt gets short-lived token
+	code, body = token("cmVjZWlwdA==")
+	require.Equal(t, http.StatusOK, code, string(body))
+	provisional := parseToken(t, body)
+	require.True(t, provisional.Provisional)
+	require.Equal(t, good.UID, provisional.UID)
+	require.InDelta(t, time.Now().Add(defaultProvisionalPeriod).Unix(), provisional.ExpiresAt, 5)
+
+	resp := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(body, &resp))
+	require.Equal(t, true, resp["provisional"])
+
+	// the unknown one is rejected
+	code, body = token("b3RoZXI=")
+	require.Equal(t, http.StatusInternalServerError, code, string(body))
+	require.Len(t, apple.Requests(), 2)
+}
+
+func TestProvisionalExpiration(t *testing.T) {
+	ctx := context.Background()
+	cause := errors.New("apple is down")
+	subscription := func(otid string, expires time.Time) iap.AutoRenewable {
+		return iap.AutoRenewable{InApp: iap.InApp{OriginalTransactionID: otid, SubscriptionExpirationDate: iap.Time{Time: expires}}, State: iap.ARActive}
+	}
+
+	testcases := []struct {
+		name          string
+		subscriptions []iap.AutoRenewable
+		refund        string
+		expectErr     error
+		expectExpires time.Time
+	}{
+		{"active", []iap.AutoRenewable{subscription("1", time.Now().Add(time.Hour))}, "", nil, time.Now().Add(defaultProvisionalPeriod)},
+		{"expires soon", []iap.AutoRenewable{subscription("1", time.Now().Add(time.Minute))}, "", nil, time.Now().Add(time.Minute)},
+		{"earliest of subscriptions", []iap.AutoRenewable{subscription("1", time.Now().Add(time.Hour)), subscription("2", time.Now().Add(2*time.Minute))}, "", nil, time.Now().Add(2 * time.Minute)},
+		{"expired", []iap.AutoRenewable{subscription("1", time.Now().Add(-time.Minute))}, "", cause, time.Time{}},
+		{"refunded", []iap.AutoRenewable{subscription("1", time.Now().Add(time.Hour))}, "1", cause, time.Time{}},
+		{"other refunded", []iap.AutoRenewable{subscription("1", time.Now().Add(time.Hour))}, "2", nil, time.Now().Add(defaultProvisionalPeriod)},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := NewMemoryEntitlementCache(time.Hour)
+			a := Authenticator{Period: time.Hour, Fallback: cache}
+			a.remember(ctx, []byte("cmVjZWlwdA=="), Entitlement{User: []byte("user"), Subscriptions: tc.subscriptions})
+			if tc.refund != "" {
+				n := iap.Notification{LatestExpiredReceiptInfo: iap.InAppV6{InApp: iap.InApp{OriginalTransactionID: tc.refund}}}
+				require.NoError(t, RevokeOnNotification(NewMemoryRevocationStore(time.Hour), cache)(ctx, n))
+			}
+
+			ent, err := a.provisional(ctx, []byte("cmVjZWlwdA=="), cause)
+			require.Equal(t, tc.expectErr, err)
+			if err != nil {
+				return
+			}
+			require.True(t, ent.Provisional)
+			require.WithinDuration(t, tc.expectExpires, ent.ExpiresAt, 5*time.Second)
+		})
+	}
+}
+
+func TestProvisionalRefresh(t *testing.T) {
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	paid := iaptest.NewBuilder(time.Now()).Subscribe("basic.monthly", 30*24*time.Hour, time.Hour).Receipt()
+	// Apple re-encodes the receipt, the refresh token keeps the latest one
+	paid.Latest = "bGF0ZXN0"
+	apple.SetReceipt("cmVjZWlwdA==", paid)
+
+	rs := apple.ReceiptService()
+	rs.NoSandbox = true
+	rs.Breaker = &iap.CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	a := Authenticator{
+		Keys:     testKeys,
+		Period:   time.Hour,
+		Receipts: rs,
+		Refresh:  NewMemoryRefreshStore(),
+		Fallback: NewMemoryEntitlementCache(24 * time.Hour),
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, tokenRequest(t, map[string]string{"receipt": "cmVjZWlwdA=="}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	good := parseToken(t, w.Body.Bytes())
+	first := refreshToken(t, w.Body.Bytes())
+
+	// apple goes down, the failure opens the circuit
+	apple.Fail(iaptest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(first))
+	require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+
+	// the entitlement is found by the latest receipt
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(first))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	provisional := parseToken(t, w.Body.Bytes())
+	require.True(t, provisional.Provisional)
+	require.Equal(t, good.UID, provisional.UID)
+	second := refreshToken(t, w.Body.Bytes())
+
+	// the rotated token keeps the latest receipt too
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, refreshRequest(second))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.True(t, parseToken(t, w.Body.Bytes()).Provisional)
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Loofort/ios-back/log"
+	"github.com/Loofort/ios-back/reply"
+	"github.com/Loofort/ios-back/usage"
+)
+
+// GrantRefreshToken is the grant_type of the request exchanging refresh token for a new access token.
+const GrantRefreshToken = "refresh_token"
+
+const defaultRefreshPeriod = 30 * 24 * time.Hour
+
+// RefreshToken is the server side state of the opaque refresh token.
+// Tokens rotate on every use, all the rotated tokens of the same initial authentication share the Family.
+type RefreshToken struct {
+	ID          string // hash of the opaque token, the token itself is never stored
+	Family      string
+	UID         string
+	BundleID    string
+	IDForVendor string
+	AppleSub    string // Apple user id, if the user signed in with Apple
+	Receipt     []byte // the latest receipt (base64), it's used to re-check the subscriptions
+	ExpiresAt   time.Time
+	Used        bool // the token was already exchanged
+}
+
+// RefreshStore keeps refresh tokens.
+type RefreshStore interface {
+	// Save stores the new token.
+	Save(ctx context.Context, rt RefreshToken) error
+	// Load returns the token without changing it.
+	Load(ctx context.Context, id string) (rt RefreshToken, found bool, err error)
+	// Rotate marks the token as used and returns its state before the call.
+	// It must be atomic: only one of concurrent calls gets the token with Used=false.
+	Rotate(ctx context.Context, id string) (rt RefreshToken, found bool, err error)
+	// RevokeFamily deletes all the tokens of the family.
+	RevokeFamily(ctx context.Context, family string) error
+}
+
+// RefreshTokenID returns the id the token is stored by.
+func RefreshTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newOpaqueToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// replyTokens replies with access token and, if refresh store is set, with new refresh token.
+// The empty rt.Family starts a new family.
+func (a Authenticator) replyTokens(ctx context.Context, w http.ResponseWriter, claims Claims, rt RefreshToken, extra map[string]interface{}) {
+	if a.Refresh == nil {
+		replyToken(ctx, w, a.Keys, claims, extra)
+		return
+	}
+
+	token, err := a.issueRefresh(ctx, claims, rt)
+	if err != nil {
+		log.Error(ctx, "unable to issue refresh token", "err", err, "type", "auth.refresh")
+		reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if extra == nil {
+		extra = map[string]interface{}{}
+	}
+	extra["refresh_token"] = token
+	replyToken(ctx, w, a.Keys, claims, extra)
+}
+
+func (a Authenticator) issueRefresh(ctx context.Context, claims Claims, rt RefreshToken) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	if rt.Family == "" {
+		if rt.Family, err = newOpaqueToken(); err != nil {
+			return "", err
+		}
+	}
+
+	period := a.RefreshPeriod
+	if period == 0 {
+		period = defaultRefreshPeriod
+	}
+
+	rt.ID = RefreshTokenID(token)
+	rt.UID = claims.UID
+	rt.ExpiresAt = time.Now().Add(period)
+	rt.Used = false
+	return token, a.Refresh.Save(ctx, rt)
+}
+
+// refresh exchanges refresh token for a new pair of tokens.
+// The subscriptions are checked again with the stored receipt, the token is rotated only if they are,
+// so the app could retry with the same token after Apple failure.
+// Reuse of the rotated token means it was stolen, so the whole family is revoked.
+func (a Authenticator) refresh(w http.ResponseWriter, r *http.Request) {
+	ctx := usage.NewContext(r.Context(), "grant_type", GrantRefreshToken)
+
+	if a.Refresh == nil {
+		reply.Err(ctx, w, http.StatusBadRequest, "unsupported grant_type")
+		return
+	}
+
+	token := r.FormValue("refresh_token")
+	if token == "" {
+		reply.Err(ctx, w, http.StatusBadRequest, "please provide refresh_token")
+		return
+	}
+
+	id := RefreshTokenID(token)
+	rt, found, err := a.Refresh.Load(ctx, id)
+	if err != nil {
+		log.Error(ctx, "unable to load refresh token", "err", err, "type", "auth.refresh")
+		reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if !found || time.Now().After(rt.ExpiresAt) {
+		reply.Err(ctx, w, http.StatusBadRequest, "invalid refresh token")
+		return
+	}
+
+	ctx = usage.NewContext(ctx,
+		"uid", rt.UID,
+		"bundle_id", rt.BundleID,
+		"device_id", rt.IDForVendor,
+	)
+
+	if rt.Used {
+		a.revokeReused(ctx, w, rt)
+		return
+	}
+
+	a, ok := a.forTenant(rt.BundleID)
+	if !ok {
+		// the app was removed from tenants
+		reply.Err(ctx, w, http.StatusBadRequest, "invalid refresh token")
+		return
+	}
+	ctx = usage.NewContext(ctx, "tenant", a.tenant)
+	if rt.AppleSub != "" {
+		a.Identity = appleIdentity{sub: rt.AppleSub, base: a.Identity}
+	}
+
+	ent, ok := a.entitle(ctx, w, rt.Receipt, rt.IDForVendor)
+	if !ok {
+		return
+	}
+
+	rotated, found, err := a.Refresh.Rotate(ctx, id)
+	if err != nil {
+		log.Error(ctx, "unable to rotate refresh token", "err", err, "type", "auth.refresh")
+		reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if !found || rotated.Used {
+		// the concurrent request has rotated it first
+		a.revokeReused(ctx, w, rotated)
+		return
+	}
+
+	claims := a.newClaims(ent.ExpiresAt, ent.User, 0)
+	claims.Entitlements = ent.Entitlements
+	claims.Provisional = ent.Provisional
+	rt.Receipt = ent.Receipt
+	a.replyTokens(ctx, w, claims, rt, nil)
+}
+
+// revokeReused revokes the family of the token used twice.
+func (a Authenticator) revokeReused(ctx context.Context, w http.ResponseWriter, rt RefreshToken) {
+	if rt.Family != "" {
+		if err := a.Refresh.RevokeFamily(ctx, rt.Family); err != nil {
+			log.Error(ctx, "unable to revoke refresh tokens", "err", err, "type", "auth.refresh")
+		}
+	}
+	// either the app is buggy or the token is stolen
+	log.Error(ctx, "refresh token reuse", "type", "auth.refresh")
+	reply.Err(ctx, w, http.StatusBadRequest, "invalid refresh token")
+}
+
+// MemoryRefreshStore is in-memory RefreshStore.
+// The tokens are lost on restart, so every user has to upload the receipt again,
+// and they are not shared between instances. The expired tokens are removed on Save.
+type MemoryRefreshStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{tokens: map[string]RefreshToken{}}
+}
+
+func (s *MemoryRefreshStore) Save(ctx context.Context, rt RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup()
+	s.tokens[rt.ID] = rt
+	return nil
+}
+
+func (s *MemoryRefreshStore) Load(ctx context.Context, id string) (RefreshToken, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.tokens[id]
+	return rt, ok, nil
+}
+
+func (s *MemoryRefreshStore) Rotate(ctx context.Context, id string) (RefreshToken, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.tokens[id]
+	if !ok {
+		return rt, false, nil
+	}
+
+	used := rt
+	used.Used = true
+	s.tokens[id] = used
+	return rt, true, nil
+}
+
+func (s *MemoryRefreshStore) RevokeFamily(ctx context.Context, family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, rt := range s.tokens {
+		if rt.Family == family {
+			delete(s.tokens, id)
+		}
+	}
+	return nil
+}
+
+// cleanup removes expired tokens, the caller holds the lock.
+func (s *MemoryRefreshStore) cleanup() {
+	now := time.Now()
+	for id, rt := range s.tokens {
+		if now.After(rt.ExpiresAt) {
+			delete(s.tokens, id)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/log"
+)
+
+// RevocationStore keeps revoked tokens, see Introspector.Revocations.
+type RevocationStore interface {
+	// RevokeToken revokes the single token by jti.
+	// The record is needed only until the token expiration (plus Introspector.Leeway).
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	// RevokeUser revokes all the tokens of the user issued up to now.
+	// The tokens issued later are valid.
+	RevokeUser(ctx context.Context, uid string) error
+	// Revoked checks if the token is revoked either by jti or by uid.
+	Revoked(ctx context.Context, claims Claims) (bool, error)
+
+	// AddSubscriber records the user the token is issued to for the subscription (original_transaction_id).
+	// The record is needed only while the token is valid, see Authenticator.Revocations.
+	AddSubscriber(ctx context.Context, originalTransactionID, uid string) error
+	// RevokeSubscription revokes all the tokens of the users recorded for the subscription, see RevokeUser.
+	RevokeSubscription(ctx context.Context, originalTransactionID string) error
+}
+
+// addSubscribers records the user of the entitlement for all its subscriptions.
+func (a Authenticator) addSubscribers(ctx context.Context, ent Entitlement) error {
+	if a.Revocations == nil {
+		return nil
+	}
+	uid := base64.RawStdEncoding.EncodeToString(ent.User)
+	for _, sbs := range ent.Subscriptions {
+		if err := a.Revocations.AddSubscriber(ctx, sbs.OriginalTransactionID, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTokenID returns random jti.
+func newTokenID() string {
+	buf := make([]byte, 16)
+	// crypto/rand doesn't fail on supported platforms
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// RevokeOnNotification returns iap notification callback that revokes all the tokens issued for the subscription.
+// Use it for CANCEL notification (refund or upgrade), the user has to authenticate again and gets token according to actual subscriptions.
+// The subscription is removed from the cache if it's set (Authenticator.Fallback), so no provisional token is issued for it.
+// The tokens are found by the users recorded for the subscription, whatever Identity derived them,
+// so set the store as Authenticator.Revocations too. Without it only the tokens of TransactionIdentity (SubscriptionUID) are revoked.
+func RevokeOnNotification(store RevocationStore, cache EntitlementCache) iap.NotificationCallback {
+	return func(ctx context.Context, n iap.Notification) error {
+		sbs := n.GetSupscription()
+		if cache != nil {
+			if err := cache.Invalidate(ctx, sbs.OriginalTransactionID); err != nil {
+				return err
+			}
+		}
+
+		log.Info(ctx, "revoke subscription tokens", "original_transaction_id", sbs.OriginalTransactionID, "type", "auth.revoke")
+		if err := store.RevokeSubscription(ctx, sbs.OriginalTransactionID); err != nil {
+			return err
+		}
+		return store.RevokeUser(ctx, SubscriptionUID(sbs.InApp))
+	}
+}
+
+// memory stores remove outdated records not more often than this
+const revocationCleanupInterval = time.Minute
+
+// MemoryRevocationStore is in-memory RevocationStore.
+// The revocations are lost on restart, so the revoked tokens are accepted again until they expire,
+// and they are not shared between instances. The outdated records are removed once a minute on any call.
+type MemoryRevocationStore struct {
+	ttl time.Duration
+
+	mu          sync.Mutex
+	tokens      map[string]time.Time            // jti -> record expiration
+	users       map[string]time.Time            // uid -> revocation time
+	subscribers map[string]map[string]time.Time // original_transaction_id -> uid -> the last issue time
+	cleanedAt   time.Time
+}
+
+// NewMemoryRevocationStore makes the store, the records are kept for ttl.
+// The ttl must be not less than the token lifetime (Authenticator.Period) plus Introspector.Leeway,
+// the expired token is accepted for the leeway, so its revocation must outlive it.
+func NewMemoryRevocationStore(ttl time.Duration) *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		ttl:         ttl,
+		tokens:      map[string]time.Time{},
+		users:       map[string]time.Time{},
+		subscribers: map[string]map[string]time.Time{},
+	}
+}
+
+func (s *MemoryRevocationStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup()
+	// the token is accepted for the leeway after expiration, the ttl covers it
+	until := time.Now().Add(s.ttl)
+	if expiresAt.After(until) {
+		until = expiresAt
+	}
+	s.tokens[jti] = until
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeUser(ctx context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup()
+	s.users[uid] = time.Now()
+	return nil
+}
+
+func (s *MemoryRevocationStore) Revoked(ctx context.Context, claims Claims) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup()
+	if _, ok := s.tokens[claims.Id]; ok && claims.Id != "" {
+		return true, nil
+	}
+
+	// the token issued in the same second as revocation is considered revoked
+	revokedAt, ok := s.users[claims.UID]
+	return ok && claims.IssuedAt <= revokedAt.Unix(), nil
+}
+
+func (s *MemoryRevocationStore) AddSubscriber(ctx context.Context, originalTransactionID, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup()
+	users := s.subscribers[originalTransactionID]
+	if users == nil {
+		users = map[string]time.Time{}
+		s.subscribers[originalTransactionID] = users
+	}
+	users[uid] = time.Now()
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeSubscription(ctx context.Context, originalTransactionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cleanup()
+	now := time.Now()
+	for uid := range s.subscribers[originalTransactionID] {
+		s.users[uid] = now
+	}
+	return nil
+}
+
+// cleanup removes outdated records, the caller holds the lock.
+// It scans all the records, so it's done once in revocationCleanupInterval.
+func (s *MemoryRevocationStore) cleanup() {
+	now := time.Now()
+	if now.Sub(s.cleanedAt) < revocationCleanupInterval {
+		return
+	}
+	s.cleanedAt = now
+
+	for jti, until := range s.tokens {
+		if now.After(until) {
+			delete(s.tokens, jti)
+		}
+	}
+	for uid, revokedAt := range s.users {
+		if now.After(revokedAt.Add(s.ttl)) {
+			delete(s.users, uid)
+		}
+	}
+	for otid, users := range s.subscribers {
+		for uid, issuedAt := range users {
+			if now.After(issuedAt.Add(s.ttl)) {
+				delete(users, uid)
+			}
+		}
+		if len(users) == 0 {
+			delete(s.subscribers, otid)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/iap/iaptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntrospectorRevocations(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRevocationStore(time.Hour)
+
+	ok := func(claims Claims) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	handler := Introspector{Keys: testKeys, Revocations: store}.Handler(ok)
+
+	newClaims := func(uid string, issued time.Time) Claims {
+		claims := NewClaims(time.Now().Add(time.Hour), []byte(uid), 0)
+		claims.IssuedAt = issued.Unix()
+		return claims
+	}
+	earlier := time.Now().Add(-2 * time.Minute)
+
+	byJTI := newClaims("user1", earlier)
+	require.NoError(t, store.RevokeToken(ctx, byJTI.Id, time.Unix(byJTI.ExpiresAt, 0)))
+
+	sbs := iap.InApp{OriginalTransactionID: "1000000123"}
+	byUID := newClaims("user2", earlier)
+	byUID.UID = SubscriptionUID(sbs)
+	n := iap.Notification{LatestExpiredReceiptInfo: iap.InAppV6{InApp: sbs}}
+	require.NoError(t, RevokeOnNotification(store, nil)(ctx, n))
+	// pretend the revocation was a minute ago, so the user got the new token
+	store.users[byUID.UID] = time.Now().Add(-time.Minute)
+
+	reissued := byUID
+	reissued.Id = newTokenID()
+	reissued.IssuedAt = time.Now().Unix()
+
+	testcases := []struct {
+		name       string
+		claims     Claims
+		expectCode int
+	}{
+		{"valid", newClaims("user1", earlier), http.StatusOK},
+		{"revoked by jti", byJTI, http.StatusUnauthorized},
+		{"revoked by uid", byUID, http.StatusUnauthorized},
+		{"issued after revocation", reissued, http.StatusOK},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, apiRequest(t, tc.claims))
+			require.Equal(t, tc.expectCode, w.Code, w.Body.String())
+		})
+	}
+}
+
+func TestRevokeOnNotificationAccountIdentity(t *testing.T) {
+	ctx := context.Background()
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	for _, otid := range []string{"1", "2"} {
+		apple.SetReceipt("receipt"+otid, iaptest.Receipt{
+			Transactions: []iaptest.Transaction{
+				{ProductID: "basic.monthly", TransactionID: otid, OriginalTransactionID: otid, ExpiresDate: time.Now().Add(time.Hour)},
+			},
+		})
+	}
+
+	accounts, err := NewFileAccountStore("")
+	require.NoError(t, err)
+	store := NewMemoryRevocationStore(time.Hour)
+	a := Authenticator{
+		Keys:        testKeys,
+		Period:      time.Hour,
+		Receipts:    apple.ReceiptService(),
+		Identity:    AccountIdentity{Store: accounts},
+		Revocations: store,
+	}
+	token := func(receipt string) Claims {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, tokenRequest(t, map[string]string{"receipt": receipt}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return parseToken(t, w.Body.Bytes())
+	}
+	refunded := token("receipt1")
+	other := token("receipt2")
+	require.NotEqual(t, SubscriptionUID(iap.InApp{OriginalTransactionID: "1"}), refunded.UID)
+
+	ok := func(claims Claims) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+	handler := Introspector{Keys: testKeys, Revocations: store}.Handler(ok)
+
+	n := iap.Notification{LatestExpiredReceiptInfo: iap.InAppV6{InApp: iap.InApp{OriginalTransactionID: "1"}}}
+	require.NoError(t, RevokeOnNotification(store, nil)(ctx, n))
+
+	w := httptest.NewRecorder()
+	handler(w, apiRequest(t, refunded))
+	require.Equal(t, http.StatusUnauthorized, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler(w, apiRequest(t, other))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestMemoryRevocationStoreCleanup(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRevocationStore(time.Millisecond)
+	require.NoError(t, store.RevokeUser(ctx, "user"))
+	require.NoError(t, store.RevokeToken(ctx, "jti", time.Now()))
+	require.NoError(t, store.AddSubscriber(ctx, "1", "user"))
+	time.Sleep(5 * time.Millisecond)
+
+	// the read-only workload frees the memory too
+	store.cleanedAt = time.Time{}
+	revoked, err := store.Revoked(ctx, Claims{UID: "user"})
+	require.NoError(t, err)
+	require.False(t, revoked)
+	require.Empty(t, store.users)
+	require.Empty(t, store.tokens)
+	require.Empty(t, store.subscribers)
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Loofort/ios-back/reply"
+)
+
+const (
+	ScopeAll     = "all"     // token of paid user
+	ScopeLimited = "limited" // token of free user, see Claims.Freebie
+)
+
+// HasScope checks the token is issued with the scope.
+func (c Claims) HasScope(scope string) bool {
+	return stringInSlice(scope, strings.Fields(c.scopes()))
+}
+
+// scopes returns space separated scopes of the token.
+func (c Claims) scopes() string {
+	if c.Scope == "" {
+		// tokens issued before scope claim was introduced
+		if c.Freebie != 0 {
+			return ScopeLimited
+		}
+		return ScopeAll
+	}
+	return c.Scope
+}
+
+// HasEntitlement checks the token carries the entitlement.
+func (c Claims) HasEntitlement(entitlement string) bool {
+	return stringInSlice(entitlement, c.Entitlements)
+}
+
+// RequireScopes allows the request only if the token has all the scopes, otherwise it replies 403.
+// e.g. RequireScopes(next, ScopeAll) forbids the free users.
+func RequireScopes(next ClaimsHandlerBuilder, scopes ...string) ClaimsHandlerBuilder {
+	return func(claims Claims) http.Handler {
+		for _, scope := range scopes {
+			if !claims.HasScope(scope) {
+				return insufficientScope(scopes)
+			}
+		}
+		return next(claims)
+	}
+}
+
+// RequireEntitlements allows the request only if the token has all the entitlements, otherwise it replies 403.
+// The entitlements come from the product catalog, see Authenticator.Catalog.
+func RequireEntitlements(next ClaimsHandlerBuilder, entitlements ...string) ClaimsHandlerBuilder {
+	return func(claims Claims) http.Handler {
+		for _, entitlement := range entitlements {
+			if !claims.HasEntitlement(entitlement) {
+				return insufficientScope(entitlements)
+			}
+		}
+		return next(claims)
+	}
+}
+
+// insufficientScope replies according to https://tools.ietf.org/html/rfc6750#section-3.1
+func insufficientScope(required []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope := strings.Join(required, " ")
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		reply.Err(r.Context(), w, http.StatusForbidden, "insufficient scope, required: "+scope)
+	}
+}
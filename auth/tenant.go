@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"sort"
+
+	"github.com/Loofort/ios-back/iap"
+)
+
+// Tenant is the app with its own App Store shared secret, products and signing keys.
+type Tenant struct {
+	// Receipts is the source of the app subscriptions, usually iap.ReceiptService
+	// with the app shared secret and sandbox policy (IsSandbox, NoSandbox).
+	Receipts iap.Verifier
+	// Catalog overrides Authenticator.Catalog if set.
+	Catalog *iap.Catalog
+	// Keys overrides Authenticator.Keys if set.
+	// The key ids must be unique across the tenants, see Tenants.KeySet.
+	Keys KeySet
+}
+
+// Tenants is the registry of the apps keyed by bundle id.
+type Tenants map[string]Tenant
+
+// KeySet returns the keys of all the tenants, use it to verify the tokens of any tenant.
+// The set has no signing key. The tenants without own keys sign with Authenticator.Keys, add them if any.
+// The token of any tenant passes the set, so the API of a single app must set Introspector.Tenant as well.
+func (ts Tenants) KeySet() KeySet {
+	bundles := make([]string, 0, len(ts))
+	for bundleID := range ts {
+		bundles = append(bundles, bundleID)
+	}
+	sort.Strings(bundles)
+
+	var keys KeySet
+	for _, bundleID := range bundles {
+		t := ts[bundleID]
+		if t.Keys.Signing.Method != nil {
+			keys.Previous = append(keys.Previous, t.Keys.Signing)
+		}
+		keys.Previous = append(keys.Previous, t.Keys.Previous...)
+	}
+	return keys
+}
+
+// forTenant returns Authenticator with the settings of the tenant, false if the bundle is unknown.
+// Without tenants any bundle is served by the Authenticator itself.
+func (a Authenticator) forTenant(bundleID string) (Authenticator, bool) {
+	if a.Tenants == nil {
+		return a, true
+	}
+
+	t, ok := a.Tenants[bundleID]
+	if !ok {
+		return a, false
+	}
+
+	a.tenant = bundleID
+	a.Receipts = t.Receipts
+	if t.Catalog != nil {
+		a.Catalog = t.Catalog
+	}
+	if t.Keys.Signing.Method != nil {
+		a.Keys = t.Keys
+	}
+	return a, true
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticatorTenants(t *testing.T) {
+	// apple knows only the secret of the first app
+	apple := appleServer(t, subscription("basic.monthly", "1", time.Now().Add(time.Hour)))
+	apple.Secret = "secret one"
+	client := apple.Client()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	a := Authenticator{
+		Keys:   testKeys,
+		Period: time.Hour,
+		Tenants: Tenants{
+			"com.myfirm.one": {
+				Receipts: iap.ReceiptService{Secret: "secret one", Client: client},
+				Keys:     KeySet{Signing: NewECDSAKey("one", key)},
+			},
+			"com.myfirm.two": {
+				Receipts: iap.ReceiptService{Secret: "secret two", Client: client},
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, tokenRequest(t, map[string]string{"bundle_id": "com.myfirm.one"}))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	resp := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	claims := Claims{}
+	token, err := jwt.ParseWithClaims(resp["access_token"].(string), &claims, a.Tenants.KeySet().Keyfunc)
+	require.NoError(t, err)
+	require.Equal(t, "one", token.Header["kid"])
+	require.Equal(t, "com.myfirm.one", claims.Tenant)
+
+	// the token of the first app is not accepted by the api of the second one
+	in := Introspector{Keys: a.Tenants.KeySet(), Tenant: "com.myfirm.one"}
+	_, errmsg, err := in.verify(context.Background(), resp["access_token"].(string))
+	require.NoError(t, err)
+	require.Empty(t, errmsg)
+	in.Tenant = "com.myfirm.two"
+	_, errmsg, err = in.verify(context.Background(), resp["access_token"].(string))
+	require.NoError(t, err)
+	require.Contains(t, errmsg, "unexpected tenant")
+
+	// the second app has its own secret, apple rejects it and it's treated as internal error
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, tokenRequest(t, map[string]string{"bundle_id": "com.myfirm.two"}))
+	require.Equal(t, http.StatusInternalServerError, w.Code, w.Body.String())
+
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, tokenRequest(t, map[string]string{"bundle_id": "com.myfirm.unknown"}))
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), "unregistered bundle")
+}
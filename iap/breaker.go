@@ -0,0 +1,112 @@
+package iap
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned by ReceiptService without requesting Apple while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("verifyReceipt is unavailable: circuit breaker is open")
+
+// IsCircuitOpen reports whether the request wasn't sent because the circuit is open, the error may be wrapped.
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, ErrCircuitOpen)
+}
+
+// CircuitBreaker stops verifyReceipt requests after consecutive failures, so the callers fail fast while Apple is down.
+// After the cooldown a single probe request is let through, its success closes the circuit.
+// The failure is the request error or retryable status after all retries, see RetryPolicy.
+// Every endpoint (production and sandbox) has its own circuit, the sandbox outage doesn't stop production requests.
+// It keeps the state, so use it by pointer.
+type CircuitBreaker struct {
+	Threshold int           // consecutive failures to open the circuit, 5 by default
+	Cooldown  time.Duration // how long the circuit stays open before the probe, 30 seconds by default
+
+	mu       sync.Mutex
+	circuits map[string]*circuit // by endpoint url
+}
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// circuit returns the state of the endpoint, the caller holds the lock.
+func (cb *CircuitBreaker) circuit(url string) *circuit {
+	c, ok := cb.circuits[url]
+	if !ok {
+		if cb.circuits == nil {
+			cb.circuits = map[string]*circuit{}
+		}
+		c = &circuit{}
+		cb.circuits[url] = c
+	}
+	return c
+}
+
+// Allow returns ErrCircuitOpen if the request to the endpoint should not be sent.
+// Every allowed request must be followed by Done.
+func (cb *CircuitBreaker) Allow(url string) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuit(url)
+	if c.openedAt.IsZero() {
+		return nil
+	}
+
+	cooldown := cb.Cooldown
+	if cooldown == 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	if c.probing || time.Since(c.openedAt) < cooldown {
+		return ErrCircuitOpen
+	}
+	c.probing = true
+	return nil
+}
+
+// Done records the result of the allowed request to the endpoint.
+func (cb *CircuitBreaker) Done(url string, failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.circuit(url)
+	probe := c.probing
+	c.probing = false
+	if !failed {
+		c.failures = 0
+		c.openedAt = time.Time{}
+		return
+	}
+
+	threshold := cb.Threshold
+	if threshold == 0 {
+		threshold = defaultBreakerThreshold
+	}
+	c.failures++
+	if probe || c.failures >= threshold {
+		c.openedAt = time.Now()
+	}
+}
+
+// release ends the allowed request without result, e.g. the caller has gone away.
+func (cb *CircuitBreaker) release(url string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.circuit(url).probing = false
+}
+
+// IsOpen reports if the requests to the endpoint are stopped.
+func (cb *CircuitBreaker) IsOpen(url string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.circuit(url).openedAt.IsZero()
+}
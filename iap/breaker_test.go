@@ -0,0 +1,81 @@
+package iap_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/iap/iaptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const receipt = "cmVjZWlwdA=="
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.SetReceipt(receipt, iaptest.Receipt{})
+
+	breaker := &iap.CircuitBreaker{Threshold: 2, Cooldown: 50 * time.Millisecond}
+	rs := iap.ReceiptService{NoSandbox: true, Client: apple.Client(), Breaker: breaker}
+	rreq := iap.ReceiptRequest{ReceiptData: receipt}
+	ctx := context.Background()
+
+	// the invalid receipt is not a failure
+	_, err := rs.VerifyReceipt(ctx, iap.ReceiptRequest{ReceiptData: "dW5rbm93bg=="})
+	require.NoError(t, err)
+
+	apple.Fail(iaptest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+	for i := 0; i < 2; i++ {
+		_, err := rs.VerifyReceipt(ctx, rreq)
+		require.IsType(t, iap.HTTPError{}, err)
+	}
+	require.True(t, breaker.IsOpen(iap.ProdIAPURL))
+
+	// apple is not requested while the circuit is open
+	_, err = rs.VerifyReceipt(ctx, rreq)
+	require.Equal(t, iap.ErrCircuitOpen, err)
+	require.True(t, iap.IsCircuitOpen(fmt.Errorf("subscriptions: %w", err)))
+	require.False(t, iap.IsCircuitOpen(errors.New("verifyReceipt is unavailable")))
+	require.Len(t, apple.Requests(), 3)
+
+	// the failed probe opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	_, err = rs.VerifyReceipt(ctx, rreq)
+	require.IsType(t, iap.HTTPError{}, err)
+	_, err = rs.VerifyReceipt(ctx, rreq)
+	require.Equal(t, iap.ErrCircuitOpen, err)
+
+	// the successful probe closes it
+	apple.ClearFaults()
+	time.Sleep(60 * time.Millisecond)
+	_, err = rs.VerifyReceipt(ctx, rreq)
+	require.NoError(t, err)
+	require.False(t, breaker.IsOpen(iap.ProdIAPURL))
+}
+
+func TestCircuitBreakerEndpoints(t *testing.T) {
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.SetReceipt("cHJvZA==", iaptest.Receipt{})
+	apple.SetReceipt("c2FuZGJveA==", iaptest.Receipt{Environment: iaptest.Sandbox})
+
+	breaker := &iap.CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	rs := iap.ReceiptService{Client: apple.Client(), Breaker: breaker}
+	ctx := context.Background()
+
+	// the sandbox outage doesn't stop production requests
+	apple.Fail(iaptest.Fault{Environment: iaptest.Sandbox, HTTPStatus: http.StatusServiceUnavailable})
+	_, err := rs.VerifyReceipt(ctx, iap.ReceiptRequest{ReceiptData: "c2FuZGJveA=="})
+	require.IsType(t, iap.HTTPError{}, err)
+	require.True(t, breaker.IsOpen(iap.SandboxIAPURL))
+	require.False(t, breaker.IsOpen(iap.ProdIAPURL))
+
+	_, err = rs.VerifyReceipt(ctx, iap.ReceiptRequest{ReceiptData: "cHJvZA=="})
+	require.NoError(t, err)
+	_, err = rs.VerifyReceipt(ctx, iap.ReceiptRequest{ReceiptData: "c2FuZGJveA=="})
+	require.Equal(t, iap.ErrCircuitOpen, err)
+}
@@ -0,0 +1,134 @@
+package iap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Product describes the product sold in the app.
+type Product struct {
+	ID           string   `json:"id" yaml:"id"`                     // product id from App Store Connect
+	Group        string   `json:"group" yaml:"group"`               // subscription group, user has at most one active subscription per group
+	Level        int      `json:"level" yaml:"level"`               // tier level within the group, the higher level the better subscription
+	Entitlements []string `json:"entitlements" yaml:"entitlements"` // named features the product gives access to, e.g. "pro", "export"
+}
+
+// Catalog maps product ids to subscription groups, tier levels and entitlements.
+type Catalog struct {
+	Products []Product `json:"products" yaml:"products"`
+}
+
+// LoadCatalog reads the catalog in json or yaml format, the json document starts with '{', e.g.
+//
+//	{"products": [{"id": "pro.monthly", "group": "main", "level": 2, "entitlements": ["pro"]}]}
+//
+// or
+//
+//	products:
+//	  - id: pro.monthly
+//	    group: main
+//	    level: 2
+//	    entitlements: [pro]
+func LoadCatalog(r io.Reader) (Catalog, error) {
+	var c Catalog
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return c, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = json.Unmarshal(data, &c)
+	} else {
+		err = yaml.UnmarshalStrict(data, &c)
+	}
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// Validate checks the product ids are unique and not empty.
+func (c Catalog) Validate() error {
+	seen := make(map[string]bool, len(c.Products))
+	for _, p := range c.Products {
+		if p.ID == "" {
+			return errors.New("catalog: product id is empty")
+		}
+		if seen[p.ID] {
+			return fmt.Errorf("catalog: duplicated product id %s", p.ID)
+		}
+		seen[p.ID] = true
+	}
+	return nil
+}
+
+// Product returns the product by id.
+func (c Catalog) Product(id string) (Product, bool) {
+	for _, p := range c.Products {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Product{}, false
+}
+
+// Best picks the best subscription in each group: the highest tier level, then the latest entitlement date.
+// Subscriptions of products unknown to catalog are skipped.
+// The result is sorted by group, the caller is responsible for filtering out inactive subscriptions.
+func (c Catalog) Best(subs []AutoRenewable) []AutoRenewable {
+	best := map[string]AutoRenewable{}
+	for _, sbs := range subs {
+		p, ok := c.Product(sbs.ProductID)
+		if !ok {
+			continue
+		}
+
+		cur, ok := best[p.Group]
+		if !ok {
+			best[p.Group] = sbs
+			continue
+		}
+
+		curp, _ := c.Product(cur.ProductID)
+		if p.Level > curp.Level || (p.Level == curp.Level && sbs.EntitledUntil().After(cur.EntitledUntil())) {
+			best[p.Group] = sbs
+		}
+	}
+
+	groups := make([]string, 0, len(best))
+	for group := range best {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	result := make([]AutoRenewable, 0, len(best))
+	for _, group := range groups {
+		result = append(result, best[group])
+	}
+	return result
+}
+
+// Entitlements returns the sorted union of entitlements given by the subscriptions.
+func (c Catalog) Entitlements(subs []AutoRenewable) []string {
+	set := map[string]bool{}
+	for _, sbs := range subs {
+		p, _ := c.Product(sbs.ProductID)
+		for _, e := range p.Entitlements {
+			set[e] = true
+		}
+	}
+
+	entitlements := make([]string, 0, len(set))
+	for e := range set {
+		entitlements = append(entitlements, e)
+	}
+	sort.Strings(entitlements)
+	return entitlements
+}
@@ -0,0 +1,72 @@
+package iap
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testCatalog = `{"products": [
+	{"id": "basic.monthly", "group": "main", "level": 1, "entitlements": ["read"]},
+	{"id": "pro.monthly", "group": "main", "level": 2, "entitlements": ["read", "pro"]},
+	{"id": "export.yearly", "group": "addons", "level": 1, "entitlements": ["export"]}
+]}`
+
+func TestCatalog(t *testing.T) {
+	c, err := LoadCatalog(strings.NewReader(testCatalog))
+	require.NoError(t, err)
+
+	now := time.Now()
+	subs := []AutoRenewable{
+		{InApp: InApp{ProductID: "basic.monthly", SubscriptionExpirationDate: Time{now.Add(2 * time.Hour)}}},
+		{InApp: InApp{ProductID: "pro.monthly", SubscriptionExpirationDate: Time{now.Add(time.Hour)}}},
+		{InApp: InApp{ProductID: "export.yearly", SubscriptionExpirationDate: Time{now.Add(time.Hour)}}},
+		{InApp: InApp{ProductID: "unknown", SubscriptionExpirationDate: Time{now.Add(time.Hour)}}},
+	}
+
+	best := c.Best(subs)
+	require.Len(t, best, 2)
+	require.Equal(t, "export.yearly", best[0].ProductID)
+	require.Equal(t, "pro.monthly", best[1].ProductID)
+
+	require.Equal(t, []string{"export", "pro", "read"}, c.Entitlements(best))
+	require.Empty(t, c.Entitlements(nil))
+
+	_, err = LoadCatalog(strings.NewReader(`{"products": [{"id": "a"}, {"id": "a"}]}`))
+	require.Error(t, err)
+}
+
+func TestLoadCatalogYAML(t *testing.T) {
+	c, err := LoadCatalog(strings.NewReader(`
+# tiers of the main group
+products:
+  - id: basic.monthly
+    group: main
+    level: 1
+    entitlements: [read]
+  - id: pro.monthly
+    group: main
+    level: 2
+    entitlements:
+      - read
+      - pro
+  - id: export.yearly
+    group: addons
+    level: 1
+    entitlements: [export]
+`))
+	require.NoError(t, err)
+
+	expected, err := LoadCatalog(strings.NewReader(testCatalog))
+	require.NoError(t, err)
+	require.Equal(t, expected, c)
+
+	_, err = LoadCatalog(strings.NewReader("products:\n  - id: a\n  - id: a\n"))
+	require.Error(t, err)
+
+	// the typo is not silently ignored
+	_, err = LoadCatalog(strings.NewReader("products:\n  - id: a\n    entitlement: [pro]\n"))
+	require.Error(t, err)
+}
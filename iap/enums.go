@@ -0,0 +1,159 @@
+package iap
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NotificationType is the type of status update notification (V1).
+// Unknown types are kept as is.
+type NotificationType string
+
+const (
+	// Occurs at the initial purchase of the subscription. Store the latest_receipt on your server as a token to verify the user’s subscription status at any time, by validating it with the App Store.
+	NotificationInitialBuy NotificationType = "INITIAL_BUY"
+	// Indicates that the subscription was canceled either by Apple customer support or by the App Store when the user upgraded their subscription. The cancellation_date key contains the date and time when the subscription was canceled or upgraded.
+	NotificationCancel NotificationType = "CANCEL"
+	// Indicates successful automatic renewal of an expired subscription that failed to renew in the past. Check subscription_expiraton_date to determine the next renewal date and time.
+	NotificationRenewal NotificationType = "RENEWAL"
+	// Indicates the customer renewed a subscription interactively, either by using your app’s interface, or on the App Store in account settings. Make service available immediately.
+	NotificationInteractiveRenewal NotificationType = "INTERACTIVE_RENEWAL"
+	// Indicates the customer made a change in their subscription plan that takes effect at the next renewal. The currently active plan is not affected.
+	NotificationDidChangeRenewalPref NotificationType = "DID_CHANGE_RENEWAL_PREF"
+	// Indicates a change in the subscription renewal status. Check the timestamp for the data and time of the latest status update, and the auto_renew_status for the current renewal status.
+	NotificationDidChangeRenewalStatus NotificationType = "DID_CHANGE_RENEWAL_STATUS"
+)
+
+func (t NotificationType) String() string {
+	return string(t)
+}
+
+// ExpirationIntent is the reason a subscription expired.
+// It's zero if the subscription is not expired or Apple hasn't sent the reason.
+type ExpirationIntent int
+
+const (
+	ExpirationCanceled           ExpirationIntent = 1 // Customer canceled their subscription.
+	ExpirationBillingError       ExpirationIntent = 2 // Billing error; for example customer’s payment information was no longer valid.
+	ExpirationPriceIncrease      ExpirationIntent = 3 // Customer did not agree to a recent price increase.
+	ExpirationProductUnavailable ExpirationIntent = 4 // Product was not available for purchase at the time of renewal.
+	ExpirationUnknown            ExpirationIntent = 5 // Unknown error.
+)
+
+var expirationIntentNames = map[ExpirationIntent]string{
+	ExpirationCanceled:           "Canceled",
+	ExpirationBillingError:       "BillingError",
+	ExpirationPriceIncrease:      "PriceIncrease",
+	ExpirationProductUnavailable: "ProductUnavailable",
+	ExpirationUnknown:            "Unknown",
+}
+
+func (ei ExpirationIntent) String() string {
+	return enumString("ExpirationIntent", int(ei), expirationIntentNames[ei])
+}
+
+func (ei ExpirationIntent) MarshalJSON() ([]byte, error) {
+	return marshalEnum(int(ei))
+}
+
+func (ei *ExpirationIntent) UnmarshalJSON(buf []byte) error {
+	i, err := unmarshalEnum(buf, 0)
+	*ei = ExpirationIntent(i)
+	return err
+}
+
+// CancellationReason is the reason of refund.
+// The fields are pointers where Apple may omit it, the empty value is decoded as CancellationUnknown.
+type CancellationReason int
+
+const (
+	CancellationUnknown  CancellationReason = -1 // Apple has sent empty value, it's not a real reason.
+	CancellationOther    CancellationReason = 0  // Transaction was canceled for another reason, for example, if the customer made the purchase accidentally.
+	CancellationAppIssue CancellationReason = 1  // Customer canceled their transaction due to an actual or perceived issue within your app.
+)
+
+var cancellationReasonNames = map[CancellationReason]string{
+	CancellationUnknown:  "Unknown",
+	CancellationOther:    "Other",
+	CancellationAppIssue: "AppIssue",
+}
+
+func (cr CancellationReason) String() string {
+	return enumString("CancellationReason", int(cr), cancellationReasonNames[cr])
+}
+
+func (cr CancellationReason) MarshalJSON() ([]byte, error) {
+	return marshalEnum(int(cr))
+}
+
+func (cr *CancellationReason) UnmarshalJSON(buf []byte) error {
+	i, err := unmarshalEnum(buf, int(CancellationUnknown))
+	*cr = CancellationReason(i)
+	return err
+}
+
+// AutoRenewStatus is the renewal status of auto-renewable subscription.
+// Receipts report it as "1"/"0", notifications (V1) as "true"/"false", both are accepted.
+// The fields are pointers where Apple may omit it, the empty value is decoded as AutoRenewUnknown.
+// Only the explicit AutoRenewOff means the subscription will not renew.
+type AutoRenewStatus int
+
+const (
+	AutoRenewUnknown AutoRenewStatus = -1 // The status is not reported.
+	AutoRenewOff     AutoRenewStatus = 0  // Customer has turned off automatic renewal for their subscription.
+	AutoRenewOn      AutoRenewStatus = 1  // Subscription will renew at the end of the current subscription period.
+)
+
+var autoRenewStatusNames = map[AutoRenewStatus]string{
+	AutoRenewUnknown: "Unknown",
+	AutoRenewOff:     "Off",
+	AutoRenewOn:      "On",
+}
+
+func (s AutoRenewStatus) String() string {
+	return enumString("AutoRenewStatus", int(s), autoRenewStatusNames[s])
+}
+
+func (s AutoRenewStatus) MarshalJSON() ([]byte, error) {
+	return marshalEnum(int(s))
+}
+
+func (s *AutoRenewStatus) UnmarshalJSON(buf []byte) error {
+	i, err := unmarshalEnum(buf, int(AutoRenewUnknown))
+	*s = AutoRenewStatus(i)
+	return err
+}
+
+func enumString(typ string, i int, name string) string {
+	if name == "" {
+		return fmt.Sprintf("%s(%d)", typ, i)
+	}
+	return name
+}
+
+// marshalEnum writes the value in the form of verifyReceipt response, that is a number in string.
+func marshalEnum(i int) ([]byte, error) {
+	return json.Marshal(strconv.Itoa(i))
+}
+
+// unmarshalEnum accepts all the forms Apple sends: 1, "1", true, "true", false and "".
+// The empty value and null are decoded as unknown, so they are not mistaken for the real 0.
+func unmarshalEnum(buf []byte, unknown int) (int, error) {
+	str := strings.Trim(string(buf), `"`)
+	switch str {
+	case "", "null":
+		return unknown, nil
+	case "false":
+		return 0, nil
+	case "true":
+		return 1, nil
+	}
+
+	i, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected enum value %s: %v", buf, err)
+	}
+	return i, nil
+}
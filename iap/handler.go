@@ -0,0 +1,93 @@
+package iap
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Loofort/ios-back/log"
+	"github.com/Loofort/ios-back/reply"
+	"github.com/Loofort/ios-back/usage"
+)
+
+// NotificationCallback handles status update notification.
+// If it returns error the handler responds with 500 and Apple will retry the notification later.
+type NotificationCallback func(ctx context.Context, n Notification) error
+
+// NotificationCallbacks routes notifications by NotificationType.
+// The nil callback means the notification is accepted but ignored.
+type NotificationCallbacks struct {
+	InitialBuy             NotificationCallback
+	Cancel                 NotificationCallback
+	Renewal                NotificationCallback
+	InteractiveRenewal     NotificationCallback
+	DidChangeRenewalPref   NotificationCallback
+	DidChangeRenewalStatus NotificationCallback
+}
+
+func (cbs NotificationCallbacks) route(notificationType NotificationType) (NotificationCallback, bool) {
+	switch notificationType {
+	case NotificationInitialBuy:
+		return cbs.InitialBuy, true
+	case NotificationCancel:
+		return cbs.Cancel, true
+	case NotificationRenewal:
+		return cbs.Renewal, true
+	case NotificationInteractiveRenewal:
+		return cbs.InteractiveRenewal, true
+	case NotificationDidChangeRenewalPref:
+		return cbs.DidChangeRenewalPref, true
+	case NotificationDidChangeRenewalStatus:
+		return cbs.DidChangeRenewalStatus, true
+	default:
+		return nil, false
+	}
+}
+
+// NotificationHandler accepts App Store server-to-server notifications (the url is set in App Store Connect).
+// It checks the notification password is the shared secret of ReceiptService and calls the callback of the notification type.
+// Without the secret anyone could post the notification, so all of them are refused.
+func NotificationHandler(rs ReceiptService, callbacks NotificationCallbacks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			reply.Err(ctx, w, http.StatusBadRequest, "unable to decode notification: "+err.Error())
+			return
+		}
+
+		ctx = usage.NewContext(ctx,
+			"notification_type", n.NotificationType,
+			"environment", n.Environment,
+			"original_transaction_id", n.GetSupscription().OriginalTransactionID,
+		)
+
+		if rs.Secret == "" {
+			log.Error(ctx, "notification shared secret is not configured", "type", "iap.notification")
+			reply.Err(ctx, w, http.StatusForbidden, "invalid password")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(n.Password), []byte(rs.Secret)) != 1 {
+			reply.Err(ctx, w, http.StatusForbidden, "invalid password")
+			return
+		}
+
+		callback, ok := callbacks.route(n.NotificationType)
+		if !ok {
+			// apple may introduce new types, it's not a reason to fail
+			log.Info(ctx, "unknown notification type", "notification_type", n.NotificationType, "type", "iap.notification")
+		}
+
+		if callback != nil {
+			if err := callback(ctx, n); err != nil {
+				log.Error(ctx, "unable to handle notification", "err", err, "type", "iap.notification")
+				reply.Err(ctx, w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+		}
+
+		reply.Ok(ctx, w, map[string]interface{}{})
+	}
+}
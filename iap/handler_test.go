@@ -0,0 +1,98 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationHandler(t *testing.T) {
+	var called []NotificationType
+	callback := func(ctx context.Context, n Notification) error {
+		called = append(called, n.NotificationType)
+		if n.OriginalTransactionID == "fail" {
+			return errors.New("callback failure")
+		}
+		return nil
+	}
+
+	rs := ReceiptService{Secret: "secret"}
+	handler := NotificationHandler(rs, NotificationCallbacks{
+		InitialBuy: callback,
+		Cancel:     callback,
+	})
+
+	testcases := []struct {
+		name         string
+		body         string
+		expectCode   int
+		expectCalled []NotificationType
+	}{
+		{
+			name:         "initial buy",
+			body:         `{"notification_type":"INITIAL_BUY","password":"secret"}`,
+			expectCode:   http.StatusOK,
+			expectCalled: []NotificationType{NotificationInitialBuy},
+		},
+		{
+			name:       "wrong password",
+			body:       `{"notification_type":"INITIAL_BUY","password":"wrong"}`,
+			expectCode: http.StatusForbidden,
+		},
+		{
+			name:       "no callback",
+			body:       `{"notification_type":"RENEWAL","password":"secret"}`,
+			expectCode: http.StatusOK,
+		},
+		{
+			name:       "unknown type",
+			body:       `{"notification_type":"PRICE_INCREASE_CONSENT","password":"secret"}`,
+			expectCode: http.StatusOK,
+		},
+		{
+			name:         "callback failure",
+			body:         `{"notification_type":"CANCEL","password":"secret","original_transaction_id":"fail"}`,
+			expectCode:   http.StatusInternalServerError,
+			expectCalled: []NotificationType{NotificationCancel},
+		},
+		{
+			name:       "malformed body",
+			body:       `{"notification_type":`,
+			expectCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			called = nil
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/notification", strings.NewReader(tc.body))
+			handler(w, r)
+
+			assert.Equal(t, tc.expectCode, w.Code)
+			assert.Equal(t, tc.expectCalled, called)
+		})
+	}
+}
+
+func TestNotificationHandlerNoSecret(t *testing.T) {
+	called := false
+	handler := NotificationHandler(ReceiptService{}, NotificationCallbacks{
+		InitialBuy: func(ctx context.Context, n Notification) error {
+			called = true
+			return nil
+		},
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/notification", strings.NewReader(`{"notification_type":"INITIAL_BUY","password":""}`))
+	handler(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.False(t, called)
+}
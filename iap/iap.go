@@ -1,10 +1,10 @@
 package iap
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -23,6 +23,26 @@ type VerifyReceiptError struct {
 	Status int
 }
 
+// ReceiptSignatureError is returned by local verification if receipt signature doesn't match the content.
+type ReceiptSignatureError struct {
+	error
+}
+
+// ReceiptCertificateError is returned by local verification if signer certificate doesn't chain up to trusted roots.
+type ReceiptCertificateError struct {
+	error
+}
+
+// ReceiptBundleError is returned by local verification if the receipt is issued for unexpected app.
+type ReceiptBundleError struct {
+	error
+}
+
+// ReceiptDeviceError is returned if the receipt hash doesn't match the device.
+type ReceiptDeviceError struct {
+	error
+}
+
 var receiptErrors = map[int]string{
 	21000: "The App Store could not read the JSON object you provided.",
 	21002: "The data in the receipt-data property was malformed or missing.",
@@ -39,52 +59,12 @@ var receiptErrors = map[int]string{
 }
 
 // VerifyReceipt send receipt to Allple server and obtain result.
-// It tries to repeat `maxretry` if resp status = 21100-21199 (is_retryable).
+// It tries to repeat `maxretry` with backoff if resp status = 21100-21199 (is_retryable), 21005 or 21009,
+// or on timeout, connection reset and http 5xx or 429, see RetryPolicy for the details.
 // If client == nil the http.Default is used
 // This is a core function, but for auto-renewable subscription the ReceiptService is more convinient
 func VerifyReceipt(ctx context.Context, rreq ReceiptRequest, url string, maxretry int, client *http.Client) (ReceiptResponse, error) {
-	rresp := ReceiptResponse{}
-
-	b := new(bytes.Buffer)
-	if err := json.NewEncoder(b).Encode(rreq); err != nil {
-		return rresp, err
-	}
-
-	req, err := http.NewRequest("POST", url, b)
-	if err != nil {
-		return rresp, err
-	}
-
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req = req.WithContext(ctx)
-
-	if client == nil {
-		client = http.DefaultClient
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return rresp, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return rresp, fmt.Errorf("unexpected http response code from apple server: %d", resp.StatusCode)
-	}
-
-	//dump, _ := httputil.DumpResponse(resp, true)
-	//fmt.Println("RESP ", string(dump))
-
-	if err := json.NewDecoder(resp.Body).Decode(&rresp); err != nil {
-		return rresp, err
-	}
-
-	// check receipt status and retry if needed
-	if rresp.Status != 0 && rresp.IsRetryable && maxretry > 0 {
-		maxretry--
-		return VerifyReceipt(ctx, rreq, url, maxretry, client)
-	}
-
-	return rresp, nil
+	return RetryPolicy{MaxRetry: maxretry}.VerifyReceipt(ctx, rreq, url, client)
 }
 
 // CheckStatusError checks the status of ReceiptResponse.
@@ -104,7 +84,7 @@ func CheckStatusError(rresp ReceiptResponse) *VerifyReceiptError {
 	}
 
 	return &VerifyReceiptError{
-		fmt.Errorf(errmasg),
+		errors.New(errmasg),
 		rresp.Status,
 	}
 }
@@ -113,14 +93,29 @@ func CheckStatusError(rresp ReceiptResponse) *VerifyReceiptError {
 // You have to specify at least the Secret.
 // It is optimized for iOS 7 style app receipts.
 type ReceiptService struct {
-	IsSandbox bool
+	IsSandbox bool // send receipts to sandbox only
+	NoSandbox bool // don't fall back to sandbox, so test receipts are not accepted in production
 	Secret    string
-	MaxRetry  int          // retry if get status code 21100-21199
+	MaxRetry  int          // the number of retries, it's used if Retry.MaxRetry is not set
 	Client    *http.Client // if omit the default is used
+
+	// Retry is the retry policy of verifyReceipt requests.
+	// The sandbox fallback is a separate request with its own retries, the total deadline is taken from the context.
+	Retry RetryPolicy
+	// Breaker if set, stops the requests while Apple is down, ErrCircuitOpen is returned instead.
+	Breaker *CircuitBreaker
 }
 
 // GetAutoRenewableIAPs returns actual auto-renewable subscriptions
 func (rs ReceiptService) GetAutoRenewableIAPs(ctx context.Context, receipt []byte, filter ARState) ([]AutoRenewable, error) {
+	subscriptions, _, err := rs.GetLatestAutoRenewableIAPs(ctx, receipt, filter)
+	return subscriptions, err
+}
+
+// GetLatestAutoRenewableIAPs is GetAutoRenewableIAPs that also returns the latest base64 receipt.
+// Keep it to check the subscriptions later on behalf of the user.
+// If Apple doesn't return the latest receipt, the passed one is returned.
+func (rs ReceiptService) GetLatestAutoRenewableIAPs(ctx context.Context, receipt []byte, filter ARState) ([]AutoRenewable, []byte, error) {
 	rreq := ReceiptRequest{
 		ReceiptData:            string(receipt),
 		Password:               rs.Secret,
@@ -129,35 +124,48 @@ func (rs ReceiptService) GetAutoRenewableIAPs(ctx context.Context, receipt []byt
 
 	rresp, err := rs.VerifyReceipt(ctx, rreq)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var iaps []InApp
+	var renewals []PendingRenewalInfo
 	if rresp.Status == 21006 {
 		// iOS 6 style
 		var iap InAppV6
 		err := json.Unmarshal(rresp.Receipt, &iap)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		iaps = append(iaps, iap.ToV7())
 
 		err = json.Unmarshal(rresp.LatesExpiredtReceiptInfo, &iap)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		iaps = append(iaps, iap.ToV7())
 
 	} else {
 		iaps, err = rresp.ParseLatestReceiptInfo()
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+
+		renewals, err = rresp.ParsePendingRenewalInfo()
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
 	subscriptions := ExtractAutoRenewable(iaps)
+	subscriptions = MergePendingRenewalInfo(subscriptions, renewals)
+
+	latest := receipt
+	if len(rresp.LatestReceipt) > 0 {
+		latest = []byte(base64.StdEncoding.EncodeToString(rresp.LatestReceipt))
+	}
+
 	if filter == 0 {
-		return subscriptions, nil
+		return subscriptions, latest, nil
 	}
 
 	var filtered []AutoRenewable
@@ -167,21 +175,45 @@ func (rs ReceiptService) GetAutoRenewableIAPs(ctx context.Context, receipt []byt
 		}
 	}
 
-	return filtered, nil
+	return filtered, latest, nil
 }
 
 // VerifyReceipt implements recommended approach to check snadbox request
 // see https://developer.apple.com/library/archive/documentation/NetworkingInternet/Conceptual/StoreKitGuide/Chapters/AppReview.html
 // do not need concurrent requests, since for the test env it's ok to have some lag.
 func (rs ReceiptService) VerifyReceipt(ctx context.Context, rreq ReceiptRequest) (ReceiptResponse, error) {
+	retry := rs.Retry
+	if retry.MaxRetry == 0 {
+		retry.MaxRetry = rs.MaxRetry
+	}
+
 	if rs.IsSandbox {
-		return VerifyReceipt(ctx, rreq, SandboxIAPURL, rs.MaxRetry, rs.Client)
+		return rs.verify(ctx, rreq, SandboxIAPURL, retry)
+	}
+
+	rresp, err := rs.verify(ctx, rreq, ProdIAPURL, retry)
+	if rresp.Status == 21007 && !rs.NoSandbox {
+		return rs.verify(ctx, rreq, SandboxIAPURL, retry)
 	}
+	return rresp, err
+}
 
-	rresp, err := VerifyReceipt(ctx, rreq, ProdIAPURL, rs.MaxRetry, rs.Client)
-	if rresp.Status == 21007 {
-		return VerifyReceipt(ctx, rreq, SandboxIAPURL, rs.MaxRetry, rs.Client)
+// verify sends the request through the circuit breaker if any.
+func (rs ReceiptService) verify(ctx context.Context, rreq ReceiptRequest, url string, retry RetryPolicy) (ReceiptResponse, error) {
+	if rs.Breaker == nil {
+		return retry.VerifyReceipt(ctx, rreq, url, rs.Client)
+	}
+
+	if err := rs.Breaker.Allow(url); err != nil {
+		return ReceiptResponse{}, err
+	}
+	rresp, err := retry.VerifyReceipt(ctx, rreq, url, rs.Client)
+	if ctx.Err() != nil {
+		// the caller has gone away, it says nothing about Apple
+		rs.Breaker.release(url)
+		return rresp, err
 	}
+	rs.Breaker.Done(url, err != nil || retry.retryable(rresp, nil))
 	return rresp, err
 }
 
@@ -202,12 +234,12 @@ type ReceiptResponse struct {
 	PendingRenewalInfo json.RawMessage `json:"pending_renewal_info"` // pending renewal information for each auto-renewable subscription identified by the Product Identifier. Refers to a renewal scheduled in the future or failed in the past.
 
 	// iOS 6 style fields
-	LatesExpiredtReceiptInfo json.RawMessage `json:"latest_expired_receipt_info"`
-	AutoRenewProductID       string          `json:"auto_renew_product_id"`
-	AutoRenewStatus          int             `json:"auto_renew_status"`
-	CancellationReason       string          `json:"cancellation_reason,omitempty"`
-	ExpirationIntent         string          `json:"expiration_intent,omitempty"`
-	IsInBillingRetryPeriod   string          `json:"is_in_billing_retry_period,omitempty"`
+	LatesExpiredtReceiptInfo json.RawMessage     `json:"latest_expired_receipt_info"`
+	AutoRenewProductID       string              `json:"auto_renew_product_id"`
+	AutoRenewStatus          *AutoRenewStatus    `json:"auto_renew_status"`
+	CancellationReason       *CancellationReason `json:"cancellation_reason,omitempty"`
+	ExpirationIntent         ExpirationIntent    `json:"expiration_intent,omitempty"`
+	IsInBillingRetryPeriod   string              `json:"is_in_billing_retry_period,omitempty"`
 }
 
 // func parse(rresp ReceiptResponse, data json.RawMessage, obj interface{}) error {
@@ -271,7 +303,7 @@ func (t *Time) UnmarshalJSON(buf []byte) error {
 		return err
 	}
 
-	t.Time = time.Unix(0, ms*1E6)
+	t.Time = time.Unix(0, ms*1e6)
 	return nil
 }
 
@@ -324,9 +356,8 @@ type InApp struct {
 	// Note: A canceled in-app purchase remains in the receipt indefinitely. Only applicable if the refund was for a non-consumable product, an auto-renewable subscription, a non-renewing subscription, or for a free subscription.
 	CancellationDate Time `json:"cancellation_date_ms"` // RFC 3339 . Treat a canceled receipt the same as if no purchase had ever been made.
 
-	// “1” - Customer canceled their transaction due to an actual or perceived issue within your app.
-	// “0” - Transaction was canceled for another reason, for example, if the customer made the purchase accidentally.
-	CancellationReason int `json:"cancellation_reason,string"` // Use this value along with the cancellation date to identify possible issues in your app that may lead customers to contact Apple customer support.
+	// see CancellationReason constants, nil if the transaction is not canceled.
+	CancellationReason *CancellationReason `json:"cancellation_reason"` // Use this value along with the cancellation date to identify possible issues in your app that may lead customers to contact Apple customer support.
 
 	//only for auto-renewable. identify the date when subscription will renew or expire,  past date means expired.
 	SubscriptionExpirationDate Time `json:"expires_date_ms"` // unix timestamp. RFC 3339 date. The expiration date for the subscription,
@@ -356,16 +387,14 @@ type PendingRenewalInfo struct {
 	// “0” - App Store has stopped attempting to renew the subscription.
 	SubscriptionRetryFlag int `json:"is_in_billing_retry_period,string"` //only present for an expired subscription, whether or not Apple is still attempting to automatically renew the subscription.
 
-	//“1” - Customer canceled their subscription.
-	//“2” - Billing error; for example customer’s payment information was no longer valid.
-	//“3” - Customer did not agree to a recent price increase.
-	//“4” - Product was not available for purchase at the time of renewal.
-	//“5” - Unknown error.
-	SubscriptionExpirationIntent int `json:"expiration_intent,string"` // only present for an expired subscription, the reason of expiration.
+	// only present if the subscription is in billing grace period, user should keep access until this date.
+	GracePeriodExpiresDate Time `json:"grace_period_expires_date_ms"`
 
-	// “1” - Subscription will renew at the end of the current subscription period.
-	// “0” - Customer has turned off automatic renewal for their subscription.
-	SubscriptionAutoRenewStatus int `json:"auto_renew_status,string"` // only for auto-renewable.  The current renewal status for the auto-renewable subscription.
+	// see ExpirationIntent constants.
+	SubscriptionExpirationIntent ExpirationIntent `json:"expiration_intent"` // only present for an expired subscription, the reason of expiration.
+
+	// see AutoRenewStatus constants, nil if Apple hasn't sent it.
+	SubscriptionAutoRenewStatus *AutoRenewStatus `json:"auto_renew_status"` // only for auto-renewable.  The current renewal status for the auto-renewable subscription.
 
 	// “1” - Customer has agreed to the price increase. Subscription will renew at the higher price.
 	// “0” - Customer has not taken action regarding the increased price. Subscription expires if the customer takes no action before the renewal date.
@@ -375,6 +404,24 @@ type PendingRenewalInfo struct {
 type AutoRenewable struct {
 	InApp
 	State ARState
+
+	// next fields are joined from pending_renewal_info by original_transaction_id.
+	// They are zero if there is no renewal info for the subscription, except AutoRenewStatus which is AutoRenewUnknown.
+	AutoRenewStatus    AutoRenewStatus
+	AutoRenewProductID string // the product the subscription renews to, differs from ProductID if downgrade is pending
+	ExpirationIntent   ExpirationIntent
+	PriceConsentStatus int  // 1 - customer has agreed to the price increase
+	IsInBillingRetry   bool // App Store is still attempting to renew the expired subscription
+
+	GracePeriodExpiresDate Time // user keeps access until this date while App Store retries the payment
+}
+
+// EntitledUntil returns the date the user has access until: the expiration date or the end of billing grace period.
+func (sbs AutoRenewable) EntitledUntil() time.Time {
+	if sbs.State&ARGracePeriod > 0 {
+		return sbs.GracePeriodExpiresDate.Time
+	}
+	return sbs.SubscriptionExpirationDate.Time
 }
 
 type ARState byte
@@ -384,18 +431,59 @@ const (
 	ARFree
 	ARExpired
 	ARCanceled
+	ARBillingRetry // expired, but App Store is still attempting to renew
+	ARWillNotRenew // customer has turned off automatic renewal
+	ARGracePeriod  // expired, but user keeps access in billing grace period, see EntitledUntil
 )
 
 func ExtractAutoRenewable(iaps []InApp) []AutoRenewable {
 	subs := make([]AutoRenewable, 0, len(iaps))
 	for _, p := range iaps {
 		state := getState(p)
-		sub := AutoRenewable{p, state}
+		sub := AutoRenewable{InApp: p, State: state, AutoRenewStatus: AutoRenewUnknown}
 		subs = append(subs, sub)
 	}
 	return subs
 }
 
+// MergePendingRenewalInfo joins subscriptions with their renewal info by original_transaction_id,
+// and sets ARBillingRetry, ARGracePeriod and ARWillNotRenew states.
+func MergePendingRenewalInfo(subs []AutoRenewable, renewals []PendingRenewalInfo) []AutoRenewable {
+	byOriginalID := make(map[string]PendingRenewalInfo, len(renewals))
+	for _, ri := range renewals {
+		byOriginalID[ri.OriginalTransactionID] = ri
+	}
+
+	for i, sub := range subs {
+		ri, ok := byOriginalID[sub.OriginalTransactionID]
+		if !ok {
+			continue
+		}
+
+		if ri.SubscriptionAutoRenewStatus != nil {
+			sub.AutoRenewStatus = *ri.SubscriptionAutoRenewStatus
+		}
+		sub.AutoRenewProductID = ri.SubscriptionAutoRenewPreference
+		sub.ExpirationIntent = ri.SubscriptionExpirationIntent
+		sub.PriceConsentStatus = ri.SubscriptionPriceConsentStatus
+		sub.IsInBillingRetry = ri.SubscriptionRetryFlag == 1
+		sub.GracePeriodExpiresDate = ri.GracePeriodExpiresDate
+
+		if sub.IsInBillingRetry && sub.State&ARExpired > 0 {
+			sub.State |= ARBillingRetry
+			if sub.GracePeriodExpiresDate.After(time.Now()) {
+				sub.State |= ARGracePeriod
+			}
+		}
+		if sub.AutoRenewStatus == AutoRenewOff && sub.State&ARCanceled == 0 {
+			sub.State |= ARWillNotRenew
+		}
+		subs[i] = sub
+	}
+
+	return subs
+}
+
 func getState(p InApp) ARState {
 	switch {
 	case !p.CancellationDate.IsZero():
@@ -1,8 +1,10 @@
 package iap
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -21,17 +23,17 @@ func TestCheckStatusError(t *testing.T) {
 		{
 			"error in range: 21000",
 			ReceiptResponse{Status: 21000},
-			&VerifyReceiptError{fmt.Errorf(receiptErrors[21000]), 21000},
+			&VerifyReceiptError{errors.New(receiptErrors[21000]), 21000},
 		},
 		{
 			"error in range: 21100-21199",
 			ReceiptResponse{Status: 21100},
-			&VerifyReceiptError{fmt.Errorf(defaultStatusError), 21100},
+			&VerifyReceiptError{errors.New(defaultStatusError), 21100},
 		},
 		{
 			"unknown status: 1",
 			ReceiptResponse{Status: 1},
-			&VerifyReceiptError{fmt.Errorf(unknownStatusError), 1},
+			&VerifyReceiptError{errors.New(unknownStatusError), 1},
 		},
 	}
 
@@ -40,3 +42,109 @@ func TestCheckStatusError(t *testing.T) {
 		require.Equal(t, vrerr, tc.expect)
 	}
 }
+
+func TestEnumsUnmarshal(t *testing.T) {
+	var pri PendingRenewalInfo
+	err := json.Unmarshal([]byte(`{"expiration_intent":"2","auto_renew_status":"1"}`), &pri)
+	require.NoError(t, err)
+	require.Equal(t, ExpirationBillingError, pri.SubscriptionExpirationIntent)
+	require.Equal(t, AutoRenewOn, *pri.SubscriptionAutoRenewStatus)
+	require.Equal(t, "BillingError", pri.SubscriptionExpirationIntent.String())
+
+	var n Notification
+	err = json.Unmarshal([]byte(`{"notification_type":"SOMETHING_NEW","auto_renew_status":"false","expiration_intent":7}`), &n)
+	require.NoError(t, err)
+	require.Equal(t, NotificationType("SOMETHING_NEW"), n.NotificationType)
+	require.Equal(t, AutoRenewOff, *n.AutoRenewStatus)
+	require.Equal(t, "ExpirationIntent(7)", n.ExpirationIntent.String())
+
+	var iap InApp
+	err = json.Unmarshal([]byte(`{"cancellation_reason":"1"}`), &iap)
+	require.NoError(t, err)
+	require.Equal(t, CancellationAppIssue, *iap.CancellationReason)
+
+	data, err := json.Marshal(iap.CancellationReason)
+	require.NoError(t, err)
+	require.Equal(t, `"1"`, string(data))
+
+	err = json.Unmarshal([]byte(`{"cancellation_reason":"yes"}`), &iap)
+	require.Error(t, err)
+}
+
+func TestEnumsUnmarshalAbsent(t *testing.T) {
+	testcases := []struct {
+		name            string
+		data            string
+		expectAutoRenew *AutoRenewStatus
+		expectReason    *CancellationReason
+	}{
+		{"absent", `{}`, nil, nil},
+		{"null", `{"auto_renew_status":null,"cancellation_reason":null}`, nil, nil},
+		{"empty", `{"auto_renew_status":"","cancellation_reason":""}`, autoRenew(AutoRenewUnknown), cancellationReason(CancellationUnknown)},
+		{"explicit zero", `{"auto_renew_status":"0","cancellation_reason":"0"}`, autoRenew(AutoRenewOff), cancellationReason(CancellationOther)},
+		{"false", `{"auto_renew_status":false}`, autoRenew(AutoRenewOff), nil},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var pri PendingRenewalInfo
+			require.NoError(t, json.Unmarshal([]byte(tc.data), &pri))
+			require.Equal(t, tc.expectAutoRenew, pri.SubscriptionAutoRenewStatus)
+
+			var iap InApp
+			require.NoError(t, json.Unmarshal([]byte(tc.data), &iap))
+			require.Equal(t, tc.expectReason, iap.CancellationReason)
+
+			// only the explicit "0" means the subscription won't renew
+			subs := MergePendingRenewalInfo(ExtractAutoRenewable([]InApp{{}}), []PendingRenewalInfo{pri})
+			require.Equal(t, tc.expectAutoRenew != nil && *tc.expectAutoRenew == AutoRenewOff, subs[0].State&ARWillNotRenew > 0)
+		})
+	}
+}
+
+func cancellationReason(cr CancellationReason) *CancellationReason {
+	return &cr
+}
+
+func TestMergePendingRenewalInfo(t *testing.T) {
+	past := Time{time.Now().Add(-time.Hour)}
+	future := Time{time.Now().Add(time.Hour)}
+
+	iaps := []InApp{
+		{OriginalTransactionID: "active", SubscriptionExpirationDate: future},
+		{OriginalTransactionID: "retry", SubscriptionExpirationDate: past},
+		{OriginalTransactionID: "downgrade", ProductID: "pro", SubscriptionExpirationDate: future},
+		{OriginalTransactionID: "no-info", SubscriptionExpirationDate: future},
+		{OriginalTransactionID: "grace", SubscriptionExpirationDate: past},
+		{OriginalTransactionID: "grace-expired", SubscriptionExpirationDate: past},
+		{OriginalTransactionID: "no-status", SubscriptionExpirationDate: future},
+	}
+	renewals := []PendingRenewalInfo{
+		{OriginalTransactionID: "active", SubscriptionAutoRenewStatus: autoRenew(AutoRenewOff)},
+		{OriginalTransactionID: "retry", SubscriptionAutoRenewStatus: autoRenew(AutoRenewOn), SubscriptionRetryFlag: 1, SubscriptionExpirationIntent: ExpirationBillingError},
+		{OriginalTransactionID: "downgrade", SubscriptionAutoRenewStatus: autoRenew(AutoRenewOn), SubscriptionAutoRenewPreference: "basic"},
+		{OriginalTransactionID: "grace", SubscriptionAutoRenewStatus: autoRenew(AutoRenewOn), SubscriptionRetryFlag: 1, GracePeriodExpiresDate: future},
+		{OriginalTransactionID: "grace-expired", SubscriptionAutoRenewStatus: autoRenew(AutoRenewOn), SubscriptionRetryFlag: 1, GracePeriodExpiresDate: past},
+		{OriginalTransactionID: "no-status", SubscriptionAutoRenewPreference: "basic"},
+	}
+
+	subs := MergePendingRenewalInfo(ExtractAutoRenewable(iaps), renewals)
+
+	require.Equal(t, ARActive|ARWillNotRenew, subs[0].State)
+	require.Equal(t, ARExpired|ARBillingRetry, subs[1].State)
+	require.Equal(t, ExpirationBillingError, subs[1].ExpirationIntent)
+	require.Equal(t, ARActive, subs[2].State)
+	require.Equal(t, "basic", subs[2].AutoRenewProductID)
+	require.Equal(t, ARActive, subs[3].State)
+	require.True(t, subs[3].EntitledUntil().Equal(future.Time))
+	require.Equal(t, ARExpired|ARBillingRetry|ARGracePeriod, subs[4].State)
+	require.True(t, subs[4].EntitledUntil().Equal(future.Time))
+	require.Equal(t, ARExpired|ARBillingRetry, subs[5].State)
+	// the absent status doesn't mean the subscription won't renew
+	require.Equal(t, ARActive, subs[6].State)
+	require.Equal(t, AutoRenewUnknown, subs[6].AutoRenewStatus)
+	require.Equal(t, AutoRenewUnknown, subs[3].AutoRenewStatus)
+}
+
+func autoRenew(s AutoRenewStatus) *AutoRenewStatus {
+	return &s
+}
@@ -0,0 +1,234 @@
+package iaptest
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+)
+
+// Builder builds the receipt with subscription history, the times are relative to the given clock:
+//
+//	r := iaptest.NewBuilder(now).
+//		Subscribe("basic.monthly", month, 40*day).Trial().
+//		Renew().
+//		Upgrade("pro.monthly", 5*day).
+//		Receipt()
+//
+// The methods after Subscribe apply to the last subscribed one.
+type Builder struct {
+	now         time.Time
+	bundleID    string
+	environment string
+	seq         int64
+	subs        []*subscription
+}
+
+type subscription struct {
+	period  time.Duration
+	txs     []Transaction
+	renewal Renewal
+}
+
+// NewBuilder starts the receipt of "com.myfirm.myapp" production app, now is the time the receipt is checked at.
+func NewBuilder(now time.Time) *Builder {
+	return &Builder{now: now, bundleID: "com.myfirm.myapp", environment: Production, seq: 1000000000000000}
+}
+
+func (b *Builder) BundleID(bundleID string) *Builder {
+	b.bundleID = bundleID
+	return b
+}
+
+func (b *Builder) Sandbox() *Builder {
+	b.environment = Sandbox
+	return b
+}
+
+// Subscribe adds new subscription purchased the time ago, its first period lasts for the period.
+// The subscription will renew.
+func (b *Builder) Subscribe(productID string, period, ago time.Duration) *Builder {
+	purchase := b.now.Add(-ago)
+	tx := b.transaction(productID, purchase, period)
+	tx.OriginalTransactionID = tx.TransactionID
+	tx.OriginalPurchaseDate = purchase
+
+	b.subs = append(b.subs, &subscription{
+		period: period,
+		txs:    []Transaction{tx},
+		renewal: Renewal{
+			ProductID:             productID,
+			OriginalTransactionID: tx.OriginalTransactionID,
+			AutoRenewStatus:       iap.AutoRenewOn,
+		},
+	})
+	return b
+}
+
+// Trial marks the last period as free trial.
+func (b *Builder) Trial() *Builder {
+	b.last().TrialPeriod = true
+	return b
+}
+
+// IntroOffer marks the last period as introductory price period.
+func (b *Builder) IntroOffer() *Builder {
+	b.last().IntroOfferPeriod = true
+	return b
+}
+
+// Renew adds the next period, the product is the pending one if downgrade was scheduled.
+func (b *Builder) Renew() *Builder {
+	sub := b.current()
+	prev := sub.txs[len(sub.txs)-1]
+
+	productID := sub.renewal.AutoRenewProductID
+	if productID == "" {
+		productID = sub.renewal.ProductID
+	}
+	tx := b.transaction(productID, prev.ExpiresDate, sub.period)
+	tx.OriginalTransactionID = prev.OriginalTransactionID
+	tx.OriginalPurchaseDate = prev.OriginalPurchaseDate
+
+	sub.txs = append(sub.txs, tx)
+	sub.renewal.ProductID = productID
+	sub.renewal.AutoRenewProductID = ""
+	return b
+}
+
+// RenewUntilNow renews the subscription until the last period covers now.
+func (b *Builder) RenewUntilNow() *Builder {
+	for b.current().period > 0 && !b.last().ExpiresDate.After(b.now) {
+		b.Renew()
+	}
+	return b
+}
+
+// Upgrade switches the subscription to the product of higher level the time ago:
+// the current period is canceled and the new one of the product starts immediately.
+func (b *Builder) Upgrade(productID string, ago time.Duration) *Builder {
+	sub := b.current()
+	at := b.now.Add(-ago)
+	prev := b.last()
+	prev.CancellationDate = at
+
+	tx := b.transaction(productID, at, sub.period)
+	tx.OriginalTransactionID = prev.OriginalTransactionID
+	tx.OriginalPurchaseDate = prev.OriginalPurchaseDate
+
+	sub.txs = append(sub.txs, tx)
+	sub.renewal.ProductID = productID
+	sub.renewal.AutoRenewProductID = ""
+	return b
+}
+
+// Downgrade schedules the product of lower level, it takes effect on the next Renew.
+func (b *Builder) Downgrade(productID string) *Builder {
+	b.current().renewal.AutoRenewProductID = productID
+	return b
+}
+
+// Cancel refunds the last period the time ago, e.g. by Apple customer support.
+func (b *Builder) Cancel(reason iap.CancellationReason, ago time.Duration) *Builder {
+	tx := b.last()
+	tx.CancellationDate = b.now.Add(-ago)
+	tx.CancellationReason = reason
+	b.current().renewal.AutoRenewStatus = iap.AutoRenewOff
+	return b
+}
+
+// AutoRenewOff turns off automatic renewal, the subscription expires at the end of the last period.
+func (b *Builder) AutoRenewOff() *Builder {
+	b.current().renewal.AutoRenewStatus = iap.AutoRenewOff
+	return b
+}
+
+// Expire stops the renewal for the reason.
+func (b *Builder) Expire(intent iap.ExpirationIntent) *Builder {
+	sub := b.current()
+	sub.renewal.AutoRenewStatus = iap.AutoRenewOff
+	sub.renewal.ExpirationIntent = intent
+	return b
+}
+
+// BillingRetry makes the last period the failed renewal App Store is still trying to charge.
+// With non-zero grace the user keeps access for the grace after the period end (billing grace period).
+func (b *Builder) BillingRetry(grace time.Duration) *Builder {
+	sub := b.current()
+	sub.renewal.ExpirationIntent = iap.ExpirationBillingError
+	sub.renewal.IsInBillingRetry = true
+	if grace > 0 {
+		sub.renewal.GracePeriodExpiresDate = b.last().ExpiresDate.Add(grace)
+	}
+	return b
+}
+
+// Receipt returns the receipt state for Server.SetReceipt.
+func (b *Builder) Receipt() Receipt {
+	r := Receipt{Environment: b.environment, BundleID: b.bundleID}
+	for _, sub := range b.subs {
+		r.Transactions = append(r.Transactions, sub.txs...)
+		r.Renewals = append(r.Renewals, sub.renewal)
+	}
+	return r
+}
+
+// JSON returns verifyReceipt response with the full history of transactions.
+func (b *Builder) JSON() []byte {
+	data, err := json.Marshal(b.Receipt().response(b.environment, "", false))
+	if err != nil {
+		panic("iaptest: " + err.Error())
+	}
+	return data
+}
+
+// Response returns verifyReceipt response with the full history of transactions.
+func (b *Builder) Response() iap.ReceiptResponse {
+	rresp := iap.ReceiptResponse{}
+	if err := json.Unmarshal(b.JSON(), &rresp); err != nil {
+		panic("iaptest: " + err.Error())
+	}
+	return rresp
+}
+
+// InApps returns the transactions as iap package sees them.
+func (b *Builder) InApps() []iap.InApp {
+	iaps, err := b.Response().ParseLatestReceiptInfo()
+	if err != nil {
+		panic("iaptest: " + err.Error())
+	}
+	return iaps
+}
+
+// PendingRenewalInfo returns the renewal info as iap package sees it.
+func (b *Builder) PendingRenewalInfo() []iap.PendingRenewalInfo {
+	renewals, err := b.Response().ParsePendingRenewalInfo()
+	if err != nil {
+		panic("iaptest: " + err.Error())
+	}
+	return renewals
+}
+
+func (b *Builder) transaction(productID string, purchase time.Time, period time.Duration) Transaction {
+	b.seq++
+	return Transaction{
+		ProductID:          productID,
+		TransactionID:      strconv.FormatInt(b.seq, 10),
+		WebOrderLineItemID: strconv.FormatInt(b.seq, 10),
+		PurchaseDate:       purchase,
+		ExpiresDate:        purchase.Add(period),
+	}
+}
+
+func (b *Builder) current() *subscription {
+	if len(b.subs) == 0 {
+		panic("iaptest: no subscription, call Subscribe first")
+	}
+	return b.subs[len(b.subs)-1]
+}
+
+func (b *Builder) last() *Transaction {
+	sub := b.current()
+	return &sub.txs[len(sub.txs)-1]
+}
@@ -0,0 +1,80 @@
+package iaptest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	day   = 24 * time.Hour
+	month = 30 * day
+)
+
+func TestBuilder(t *testing.T) {
+	now := time.Now()
+
+	testcases := []struct {
+		name          string
+		builder       *Builder
+		expectProduct string
+		expectState   iap.ARState
+	}{
+		{"trial", NewBuilder(now).Subscribe("basic.monthly", month, day).Trial(), "basic.monthly", iap.ARFree},
+		{"intro offer renewed", NewBuilder(now).Subscribe("basic.monthly", month, 70*day).IntroOffer().RenewUntilNow(), "basic.monthly", iap.ARActive},
+		{"upgrade", NewBuilder(now).Subscribe("basic.monthly", month, 10*day).Upgrade("pro.monthly", 5*day), "pro.monthly", iap.ARActive},
+		{"downgrade", NewBuilder(now).Subscribe("pro.monthly", month, 40*day).Downgrade("basic.monthly").Renew(), "basic.monthly", iap.ARActive},
+		{"refund", NewBuilder(now).Subscribe("basic.monthly", month, 10*day).Cancel(iap.CancellationAppIssue, day), "basic.monthly", iap.ARCanceled},
+		{"will not renew", NewBuilder(now).Subscribe("basic.monthly", month, 10*day).AutoRenewOff(), "basic.monthly", iap.ARActive | iap.ARWillNotRenew},
+		{"expired", NewBuilder(now).Subscribe("basic.monthly", month, 40*day).Expire(iap.ExpirationCanceled), "basic.monthly", iap.ARExpired | iap.ARWillNotRenew},
+		{"billing retry", NewBuilder(now).Subscribe("basic.monthly", month, 40*day).BillingRetry(0), "basic.monthly", iap.ARExpired | iap.ARBillingRetry},
+		{"grace period", NewBuilder(now).Subscribe("basic.monthly", month, 31*day).BillingRetry(3 * day), "basic.monthly", iap.ARExpired | iap.ARBillingRetry | iap.ARGracePeriod},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			subscriptions := iap.MergePendingRenewalInfo(iap.ExtractAutoRenewable(tc.builder.InApps()), tc.builder.PendingRenewalInfo())
+			last := subscriptions[len(subscriptions)-1]
+			require.Equal(t, tc.expectProduct, last.ProductID)
+			require.Equal(t, tc.expectState, last.State)
+		})
+	}
+}
+
+func TestBuilderHistory(t *testing.T) {
+	now := time.Now()
+	b := NewBuilder(now).Sandbox().
+		Subscribe("basic.monthly", month, 70*day).Trial().
+		RenewUntilNow().
+		Upgrade("pro.monthly", day)
+
+	rresp := b.Response()
+	require.Equal(t, 0, rresp.Status)
+	require.Equal(t, Sandbox, rresp.Environment)
+
+	receipt, err := rresp.ParseReceipt()
+	require.NoError(t, err)
+	require.Equal(t, "com.myfirm.myapp", receipt.BundleID)
+
+	iaps := b.InApps()
+	require.Len(t, iaps, 4)
+	for i, p := range iaps {
+		require.Equal(t, iaps[0].TransactionID, p.OriginalTransactionID)
+		require.True(t, p.OriginalPurchaseDate.Equal(now.Add(-70*day).Truncate(time.Millisecond)))
+		require.Equal(t, i == 0, p.SubscriptionTrialPeriod)
+	}
+	// the periods follow each other
+	require.True(t, iaps[1].PurchaseDate.Equal(iaps[0].SubscriptionExpirationDate.Time))
+	require.True(t, iaps[2].PurchaseDate.Equal(iaps[1].SubscriptionExpirationDate.Time))
+	// the upgraded period is canceled
+	require.True(t, iaps[2].CancellationDate.Equal(iaps[3].PurchaseDate.Time))
+
+	// the json is verifyReceipt format
+	raw := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(b.JSON(), &raw))
+	info := raw["latest_receipt_info"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "true", info["is_trial_period"])
+	require.IsType(t, "", info["expires_date_ms"])
+}
@@ -0,0 +1,377 @@
+// Package iaptest provides fake App Store verifyReceipt server for tests.
+// The server keeps the state of receipts and replies as Apple does, including sandbox redirection (21007),
+// and the failures could be injected to exercise error paths: retryable statuses, http errors and slow replies.
+// Signer makes signed app receipts for local validation.
+package iaptest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+)
+
+// Environments of the receipt and the endpoint.
+const (
+	Production = "Production"
+	Sandbox    = "Sandbox"
+)
+
+// Transaction is the in-app purchase transaction of the receipt.
+type Transaction struct {
+	ProductID             string
+	TransactionID         string
+	OriginalTransactionID string
+	WebOrderLineItemID    string
+	PurchaseDate          time.Time
+	OriginalPurchaseDate  time.Time
+	ExpiresDate           time.Time // zero for the purchases that are not auto-renewable
+	CancellationDate      time.Time
+	CancellationReason    iap.CancellationReason
+	TrialPeriod           bool
+	IntroOfferPeriod      bool
+}
+
+// MarshalJSON encodes the transaction the way verifyReceipt does: the numbers are strings, the dates are in milliseconds.
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{
+		"quantity":                 "1",
+		"product_id":               tx.ProductID,
+		"transaction_id":           tx.TransactionID,
+		"original_transaction_id":  tx.OriginalTransactionID,
+		"is_trial_period":          strconv.FormatBool(tx.TrialPeriod),
+		"is_in_intro_offer_period": strconv.FormatBool(tx.IntroOfferPeriod),
+	}
+	if tx.WebOrderLineItemID != "" {
+		m["web_order_line_item_id"] = tx.WebOrderLineItemID
+	}
+	putMS(m, "purchase_date_ms", tx.PurchaseDate)
+	putMS(m, "original_purchase_date_ms", tx.OriginalPurchaseDate)
+	putMS(m, "expires_date_ms", tx.ExpiresDate)
+	if !tx.CancellationDate.IsZero() {
+		putMS(m, "cancellation_date_ms", tx.CancellationDate)
+		m["cancellation_reason"] = strconv.Itoa(int(tx.CancellationReason))
+	}
+	return json.Marshal(m)
+}
+
+// Renewal is the pending renewal info of auto-renewable subscription.
+type Renewal struct {
+	ProductID              string
+	OriginalTransactionID  string
+	AutoRenewProductID     string               // ProductID if empty
+	AutoRenewStatus        iap.AutoRenewStatus  // the field is omitted if it's AutoRenewUnknown
+	ExpirationIntent       iap.ExpirationIntent // zero if the subscription is not expired
+	IsInBillingRetry       bool
+	GracePeriodExpiresDate time.Time
+}
+
+// MarshalJSON encodes the renewal info the way verifyReceipt does.
+func (ri Renewal) MarshalJSON() ([]byte, error) {
+	autoRenewProductID := ri.AutoRenewProductID
+	if autoRenewProductID == "" {
+		autoRenewProductID = ri.ProductID
+	}
+	retry := "0"
+	if ri.IsInBillingRetry {
+		retry = "1"
+	}
+
+	m := map[string]interface{}{
+		"product_id":                 ri.ProductID,
+		"original_transaction_id":    ri.OriginalTransactionID,
+		"auto_renew_product_id":      autoRenewProductID,
+		"is_in_billing_retry_period": retry,
+	}
+	if ri.AutoRenewStatus != iap.AutoRenewUnknown {
+		m["auto_renew_status"] = strconv.Itoa(int(ri.AutoRenewStatus))
+	}
+	if ri.ExpirationIntent != 0 {
+		m["expiration_intent"] = strconv.Itoa(int(ri.ExpirationIntent))
+	}
+	putMS(m, "grace_period_expires_date_ms", ri.GracePeriodExpiresDate)
+	return json.Marshal(m)
+}
+
+func putMS(m map[string]interface{}, key string, t time.Time) {
+	if !t.IsZero() {
+		m[key] = strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+}
+
+// Receipt is the state of the app receipt kept by the server.
+type Receipt struct {
+	// Environment is Production (default) or Sandbox, the endpoint of another environment replies 21007 or 21008.
+	Environment  string
+	BundleID     string
+	Transactions []Transaction
+	Renewals     []Renewal
+	// Status if set, is replied instead of the receipt content, e.g. 21010 for the receipt of refunded purchase.
+	Status int
+	// Latest is the latest base64 receipt, the posted one by default.
+	Latest string
+}
+
+// Fault is the failure injected into the server replies.
+type Fault struct {
+	// Environment if set, only the requests to its endpoint fail.
+	Environment string
+	// Count is how many requests fail, 0 means all of them until ClearFaults.
+	Count int
+	// Delay delays the reply, use it to test timeouts.
+	// Without HTTPStatus and Status the reply is the usual one, just slow.
+	Delay time.Duration
+	// HTTPStatus if set, is replied instead of verifyReceipt response, e.g. 503.
+	HTTPStatus int
+	// RetryAfter if set, is sent in Retry-After header of HTTPStatus reply, it's rounded to seconds.
+	RetryAfter time.Duration
+	// Status if set, is replied as verifyReceipt status, 21100-21199 are marked as retryable.
+	Status int
+}
+
+// Request is the verifyReceipt request received by the server.
+type Request struct {
+	Environment string
+	iap.ReceiptRequest
+}
+
+// Server is fake App Store server, the production endpoint is URL+"/verifyReceipt", the sandbox one is URL+"/sandbox/verifyReceipt".
+// Use Client or ReceiptService to send the requests of iap package to the server.
+type Server struct {
+	URL string
+	// Secret if set, the requests with another password get 21004. Set it before the requests.
+	Secret string
+
+	ts *httptest.Server
+
+	mu       sync.Mutex
+	receipts map[string]Receipt
+	faults   []Fault
+	requests []Request
+}
+
+// NewServer starts the server, the caller should Close it.
+func NewServer() *Server {
+	s := &Server{receipts: map[string]Receipt{}}
+	s.ts = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.ts.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.ts.Close()
+}
+
+// Client returns http client sending the requests to App Store (iap.ProdIAPURL and iap.SandboxIAPURL) to the server.
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: rewriteTransport{s.URL}}
+}
+
+// ReceiptService returns iap.ReceiptService talking to the server.
+func (s *Server) ReceiptService() iap.ReceiptService {
+	return iap.ReceiptService{Secret: s.Secret, Client: s.Client()}
+}
+
+// SetReceipt sets the state of the receipt, the receipt is the base64 receipt-data posted by the client.
+func (s *Server) SetReceipt(receipt string, r Receipt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receipts[receipt] = r
+}
+
+// UpdateReceipt changes the state of the receipt, e.g. adds the renewal transaction.
+func (s *Server) UpdateReceipt(receipt string, update func(r *Receipt)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.receipts[receipt]
+	update(&r)
+	s.receipts[receipt] = r
+}
+
+// Fail injects the failure, the faults are applied in order they were added.
+func (s *Server) Fail(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, f)
+}
+
+// ClearFaults removes all the injected failures.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns all the requests received by the server.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	env := Production
+	if strings.HasPrefix(r.URL.Path, "/sandbox/") {
+		env = Sandbox
+	}
+
+	if r.Method != "POST" {
+		writeJSON(w, map[string]interface{}{"status": 21000})
+		return
+	}
+	rreq := iap.ReceiptRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&rreq); err != nil {
+		writeJSON(w, map[string]interface{}{"status": 21002})
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Environment: env, ReceiptRequest: rreq})
+	fault := s.fault(env)
+	receipt, ok := s.receipts[rreq.ReceiptData]
+	s.mu.Unlock()
+
+	if fault.Delay > 0 {
+		select {
+		case <-time.After(fault.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.HTTPStatus != 0 {
+		if fault.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(fault.RetryAfter/time.Second)))
+		}
+		http.Error(w, http.StatusText(fault.HTTPStatus), fault.HTTPStatus)
+		return
+	}
+	if fault.Status != 0 {
+		writeJSON(w, map[string]interface{}{
+			"status":       fault.Status,
+			"environment":  env,
+			"is_retryable": fault.Status >= 21100 && fault.Status <= 21199,
+		})
+		return
+	}
+
+	if !ok {
+		// the receipt could not be authenticated
+		writeJSON(w, map[string]interface{}{"status": 21003, "environment": env})
+		return
+	}
+	if s.Secret != "" && rreq.Password != s.Secret {
+		writeJSON(w, map[string]interface{}{"status": 21004, "environment": env})
+		return
+	}
+	writeJSON(w, receipt.response(env, rreq.ReceiptData, rreq.ExcludeOldTransactions))
+}
+
+// fault returns the first fault for the environment and counts it down, the caller holds the lock.
+func (s *Server) fault(env string) Fault {
+	for i, f := range s.faults {
+		if f.Environment != "" && f.Environment != env {
+			continue
+		}
+		if f.Count > 0 {
+			s.faults[i].Count--
+			if s.faults[i].Count == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return Fault{}
+}
+
+// response is verifyReceipt response to the receipt posted to the environment endpoint.
+func (r Receipt) response(env, receiptData string, excludeOld bool) map[string]interface{} {
+	receiptEnv := r.Environment
+	if receiptEnv == "" {
+		receiptEnv = Production
+	}
+
+	status := r.Status
+	switch {
+	case status != 0:
+	case receiptEnv == Sandbox && env == Production:
+		status = 21007
+	case receiptEnv == Production && env == Sandbox:
+		status = 21008
+	}
+	if status != 0 {
+		return map[string]interface{}{"status": status, "environment": env}
+	}
+
+	transactions := r.Transactions
+	if excludeOld {
+		transactions = latestTransactions(transactions)
+	}
+	resp := map[string]interface{}{
+		"status":      0,
+		"environment": env,
+		"receipt": map[string]interface{}{
+			"bundle_id": r.BundleID,
+			"in_app":    r.Transactions,
+		},
+		"latest_receipt_info": transactions,
+	}
+	if len(r.Renewals) > 0 {
+		resp["pending_renewal_info"] = r.Renewals
+	}
+
+	latest := r.Latest
+	if latest == "" {
+		latest = receiptData
+	}
+	// latest_receipt is decoded as []byte, so it has to be valid base64
+	if _, err := base64.StdEncoding.DecodeString(latest); err == nil {
+		resp["latest_receipt"] = latest
+	}
+	return resp
+}
+
+// latestTransactions keeps the latest transaction of each subscription, as exclude-old-transactions does.
+func latestTransactions(transactions []Transaction) []Transaction {
+	var latest []Transaction
+	index := map[string]int{}
+	for _, tx := range transactions {
+		i, ok := index[tx.OriginalTransactionID]
+		if !ok {
+			index[tx.OriginalTransactionID] = len(latest)
+			latest = append(latest, tx)
+			continue
+		}
+		if tx.ExpiresDate.After(latest[i].ExpiresDate) {
+			latest[i] = tx
+		}
+	}
+	return latest
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// rewriteTransport sends all the requests to the server, the sandbox requests go to the sandbox endpoint.
+type rewriteTransport struct{ url string }
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := "/verifyReceipt"
+	if req.URL.Host == "sandbox.itunes.apple.com" || strings.HasPrefix(req.URL.Path, "/sandbox/") {
+		path = "/sandbox/verifyReceipt"
+	}
+
+	r, err := http.NewRequest(req.Method, rt.url+path, req.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = req.Header
+	return http.DefaultTransport.RoundTrip(r.WithContext(req.Context()))
+}
@@ -0,0 +1,100 @@
+package iaptest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/stretchr/testify/require"
+)
+
+const receipt = "cmVjZWlwdA=="
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.Secret = "secret"
+
+	now := time.Now()
+	s.SetReceipt(receipt, Receipt{
+		Environment: Sandbox,
+		BundleID:    "com.myfirm.myapp",
+		Transactions: []Transaction{
+			{ProductID: "basic.monthly", TransactionID: "1", OriginalTransactionID: "1", PurchaseDate: now.Add(-48 * time.Hour), ExpiresDate: now.Add(-24 * time.Hour), TrialPeriod: true},
+			{ProductID: "basic.monthly", TransactionID: "2", OriginalTransactionID: "1", PurchaseDate: now.Add(-24 * time.Hour), ExpiresDate: now.Add(24 * time.Hour)},
+		},
+		Renewals: []Renewal{
+			{ProductID: "basic.monthly", OriginalTransactionID: "1", AutoRenewStatus: iap.AutoRenewOff},
+		},
+	})
+
+	// the sandbox receipt is redirected to sandbox
+	subscriptions, latest, err := s.ReceiptService().GetLatestAutoRenewableIAPs(context.Background(), []byte(receipt), 0)
+	require.NoError(t, err)
+	require.Equal(t, receipt, string(latest))
+	require.Len(t, subscriptions, 1)
+	require.Equal(t, "2", subscriptions[0].TransactionID)
+	require.Equal(t, iap.ARActive|iap.ARWillNotRenew, subscriptions[0].State)
+
+	requests := s.Requests()
+	require.Len(t, requests, 2)
+	require.Equal(t, Production, requests[0].Environment)
+	require.Equal(t, Sandbox, requests[1].Environment)
+	require.True(t, requests[1].ExcludeOldTransactions)
+
+	testcases := []struct {
+		name    string
+		receipt string
+		secret  string
+		expect  int
+	}{
+		{"unknown receipt", "dW5rbm93bg==", "secret", 21003},
+		{"wrong secret", receipt, "wrong", 21004},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			rs := iap.ReceiptService{Secret: tc.secret, Client: s.Client()}
+			rresp, err := rs.VerifyReceipt(context.Background(), iap.ReceiptRequest{ReceiptData: tc.receipt, Password: tc.secret})
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, rresp.Status)
+		})
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetReceipt(receipt, Receipt{BundleID: "com.myfirm.myapp"})
+	rreq := iap.ReceiptRequest{ReceiptData: receipt}
+
+	// retryable status is retried
+	s.Fail(Fault{Status: 21100, Count: 1})
+	rresp, err := iap.VerifyReceipt(context.Background(), rreq, iap.ProdIAPURL, 1, s.Client())
+	require.NoError(t, err)
+	require.Equal(t, 0, rresp.Status)
+
+	// until retries are exhausted
+	s.Fail(Fault{Status: 21199, Count: 2})
+	rresp, err = iap.VerifyReceipt(context.Background(), rreq, iap.ProdIAPURL, 1, s.Client())
+	require.NoError(t, err)
+	require.Equal(t, 21199, rresp.Status)
+	require.True(t, rresp.IsRetryable)
+
+	// the fault of another environment doesn't apply
+	s.Fail(Fault{Environment: Sandbox, HTTPStatus: http.StatusServiceUnavailable})
+	_, err = iap.VerifyReceipt(context.Background(), rreq, iap.ProdIAPURL, 0, s.Client())
+	require.NoError(t, err)
+	_, err = iap.VerifyReceipt(context.Background(), rreq, iap.SandboxIAPURL, 0, s.Client())
+	require.EqualError(t, err, "unexpected http response code from apple server: 503")
+	s.ClearFaults()
+
+	// slow reply
+	s.Fail(Fault{Delay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = iap.VerifyReceipt(ctx, rreq, iap.ProdIAPURL, 0, s.Client())
+	require.Error(t, err)
+	require.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
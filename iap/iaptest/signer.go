@@ -0,0 +1,83 @@
+package iaptest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"time"
+
+	"github.com/Loofort/ios-back/iap/internal/pkcs7test"
+	"github.com/satori/go.uuid"
+)
+
+// Signer signs app receipts the way App Store does, so the local validation (iap.LocalVerifier) could be tested:
+//
+//	signer := iaptest.NewSigner()
+//	lv := iap.LocalVerifier{Roots: signer.Roots(), BundleIDs: []string{"com.myfirm.myapp"}}
+//	receipt := signer.Receipt("com.myfirm.myapp", identifierForVendor)
+//
+// The certificates chain up to its own test root.
+type Signer struct {
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	leaf         *x509.Certificate
+	key          crypto.Signer
+}
+
+// NewSigner makes the test root, WWDR intermediate and receipt signing certificates.
+// It panics on failure, as httptest.NewServer does.
+func NewSigner() *Signer {
+	root, rootKey := pkcs7test.NewCert("Test Apple Root CA", nil, nil)
+	intermediate, intermediateKey := pkcs7test.NewCert("Test Apple WWDR", root, rootKey, pkcs7test.OIDAppleWWDR)
+	leaf, key := pkcs7test.NewCert("Test Mac App Store Receipt Signing", intermediate, intermediateKey, pkcs7test.OIDAppleStoreSigning)
+	return &Signer{root: root, intermediate: intermediate, leaf: leaf, key: key}
+}
+
+// Roots returns the pool with the test root certificate.
+func (s *Signer) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.root)
+	return pool
+}
+
+// Receipt returns the base64 app receipt issued for the app and the device (identifier_for_vendor).
+// The receipt has no in-app purchases.
+func (s *Signer) Receipt(bundleID, device string) []byte {
+	bundle := mustMarshal(asn1.MarshalWithParams(bundleID, "utf8"))
+	created := mustMarshal(asn1.MarshalWithParams(time.Now().UTC().Format(time.RFC3339), "ia5"))
+	opaque := make([]byte, 16)
+	if _, err := rand.Read(opaque); err != nil {
+		panic(err)
+	}
+
+	// the hash of invalid device can't match any, so the receipt is issued for nobody
+	guid := uuid.FromStringOrNil(device)
+	hash := sha1.Sum(append(append(guid.Bytes(), opaque...), bundle...))
+
+	payload := mustMarshal(asn1.MarshalWithParams([]receiptAttribute{
+		{Type: 2, Version: 1, Value: bundle},
+		{Type: 4, Version: 1, Value: opaque},
+		{Type: 5, Version: 1, Value: hash[:]},
+		{Type: 12, Version: 1, Value: created},
+	}, "set"))
+
+	container := pkcs7test.Sign(payload, s.key, s.leaf, s.intermediate)
+	return []byte(base64.StdEncoding.EncodeToString(container))
+}
+
+// ReceiptAttribute ::= SEQUENCE { type INTEGER, version INTEGER, value OCTET STRING }
+type receiptAttribute struct {
+	Type    int
+	Version int
+	Value   []byte
+}
+
+func mustMarshal(data []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
@@ -0,0 +1,23 @@
+package iaptest
+
+import (
+	"testing"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+	const device = "FC40A4BA-F5B2-4FC0-95E5-1179A9DE7003"
+	signer := NewSigner()
+	receipt := signer.Receipt("com.myfirm.myapp", device)
+
+	lr, err := iap.LocalVerifier{Roots: signer.Roots(), BundleIDs: []string{"com.myfirm.myapp"}}.Verify(receipt)
+	require.NoError(t, err)
+	require.Equal(t, "com.myfirm.myapp", lr.BundleID)
+	require.NoError(t, lr.CheckDeviceHash(device))
+	require.Error(t, lr.CheckDeviceHash("6AFEB3A1-2A5B-4E8C-9D3F-2F4A1E7C0B11"))
+
+	_, err = iap.LocalVerifier{Roots: NewSigner().Roots(), BundleIDs: []string{"com.myfirm.myapp"}}.Verify(receipt)
+	require.IsType(t, iap.ReceiptCertificateError{}, err)
+}
@@ -0,0 +1,182 @@
+// Package pkcs7test builds the certificates and PKCS #7 containers App Store signs app receipts with.
+// It backs iaptest.Signer and the tests of iap package, which can't import iaptest.
+// The functions panic on failure, as httptest.NewServer does.
+package pkcs7test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+)
+
+var (
+	// OIDAppleStoreSigning marks the certificate App Store signs receipts with.
+	OIDAppleStoreSigning = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	// OIDAppleWWDR marks Apple Worldwide Developer Relations intermediate certificate.
+	OIDAppleWWDR = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+
+	oidData                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256                 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidECDSAWithSHA256        = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidRSAEncryption          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+// NewCert makes ECDSA CA certificate signed by parent, if parent is nil the certificate is self-signed.
+// The certificate is marked with the extensions, e.g. OIDAppleStoreSigning.
+func NewCert(name string, parent *x509.Certificate, parentKey crypto.Signer, exts ...asn1.ObjectIdentifier) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	if parent == nil {
+		return issue(name, key, nil, key, exts...), key
+	}
+	return issue(name, key, parent, parentKey, exts...), key
+}
+
+// NewRSACert makes RSA CA certificate signed by parent.
+func NewRSACert(name string, parent *x509.Certificate, parentKey crypto.Signer, exts ...asn1.ObjectIdentifier) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return issue(name, key, parent, parentKey, exts...), key
+}
+
+func issue(name string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer, exts ...asn1.ObjectIdentifier) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		panic(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, oid := range exts {
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, pkix.Extension{Id: oid, Value: asn1.NullBytes})
+	}
+	if parent == nil {
+		parent = tmpl
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+// Sign builds DER receipt container with the payload signed by the key of cert,
+// the chain is put into the container after cert. If key is nil the container isn't signed.
+func Sign(payload []byte, key crypto.Signer, cert *x509.Certificate, chain ...*x509.Certificate) []byte {
+	return encode(payload, key, false, cert, chain...)
+}
+
+// SignWithAttributes is like Sign, but the signature is over authenticated attributes, the way older receipts are.
+func SignWithAttributes(payload []byte, key crypto.Signer, cert *x509.Certificate, chain ...*x509.Certificate) []byte {
+	return encode(payload, key, true, cert, chain...)
+}
+
+func encode(payload []byte, key crypto.Signer, withAttributes bool, cert *x509.Certificate, chain ...*x509.Certificate) []byte {
+	sha256Alg := marshal(pkix.AlgorithmIdentifier{Algorithm: oidSHA256})
+	content := tlv(0x30, marshal(oidData), tlv(0xa0, marshal(payload)))
+	if key == nil {
+		signedData := tlv(0x30, marshal(1), tlv(0x31), content, tlv(0x31))
+		return tlv(0x30, marshal(oidSignedData), tlv(0xa0, signedData))
+	}
+
+	var attributes []byte
+	signed := payload
+	if withAttributes {
+		digest := sha256.Sum256(payload)
+		attrs := [][]byte{
+			tlv(0x30, marshal(oidAttributeContentType), tlv(0x31, marshal(oidData))),
+			tlv(0x30, marshal(oidAttributeMessageDigest), tlv(0x31, marshal(digest[:]))),
+		}
+		attributes = tlv(0xa0, attrs...)
+		signed = tlv(0x31, attrs...)
+	}
+
+	digest := sha256.Sum256(signed)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		panic(err)
+	}
+
+	encryption := oidECDSAWithSHA256
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		encryption = oidRSAEncryption
+	}
+
+	certs := [][]byte{cert.Raw}
+	for _, c := range chain {
+		certs = append(certs, c.Raw)
+	}
+
+	signerInfo := tlv(0x30,
+		marshal(1),
+		tlv(0x30, cert.RawIssuer, marshal(cert.SerialNumber)),
+		sha256Alg,
+		attributes,
+		marshal(pkix.AlgorithmIdentifier{Algorithm: encryption}),
+		marshal(signature),
+	)
+	signedData := tlv(0x30,
+		marshal(1),
+		tlv(0x31, sha256Alg),
+		content,
+		tlv(0xa0, certs...),
+		tlv(0x31, signerInfo),
+	)
+	return tlv(0x30, marshal(oidSignedData), tlv(0xa0, signedData))
+}
+
+// tlv encodes DER element of the tag with the content.
+func tlv(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+
+	var length []byte
+	switch l := len(body); {
+	case l < 0x80:
+		length = []byte{byte(l)}
+	default:
+		for ; l > 0; l >>= 8 {
+			length = append([]byte{byte(l)}, length...)
+		}
+		length = append([]byte{0x80 | byte(len(length))}, length...)
+	}
+
+	return append(append([]byte{tag}, length...), body...)
+}
+
+func marshal(obj interface{}) []byte {
+	data, err := asn1.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
@@ -0,0 +1,196 @@
+package iap
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWSError is returned if App Store signed data (JWS) is malformed or its signature or certificate chain is invalid.
+type JWSError struct {
+	error
+}
+
+// JWSVerifier verifies and decodes data signed by App Store:
+// server notifications V2, transactions and renewal info returned by App Store Server API.
+// The JWS header contains x5c certificate chain that has to chain up to the trusted roots.
+type JWSVerifier struct {
+	// Roots must contain the CA the x5c header chain ends with, without it no JWS is accepted.
+	// For production use Apple Root CA - G3 from https://www.apple.com/certificateauthority/,
+	// the App Store signs JWS with ECDSA keys certified by it, not by the older Apple Inc. Root used for receipts.
+	Roots *x509.CertPool
+}
+
+type jwsHeader struct {
+	Alg string   `json:"alg"`
+	X5C []string `json:"x5c"`
+}
+
+// Verify checks the signature of JWS and unmarshals its payload into obj.
+func (v JWSVerifier) Verify(signed string, obj interface{}) error {
+	if v.Roots == nil {
+		return errors.New("no trusted root certificates are configured")
+	}
+
+	parts := strings.Split(signed, ".")
+	if len(parts) != 3 {
+		return JWSError{errors.New("jws must have 3 parts")}
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return JWSError{fmt.Errorf("unable to decode jws header: %v", err)}
+	}
+	var header jwsHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return JWSError{fmt.Errorf("unable to decode jws header: %v", err)}
+	}
+	if header.Alg != jwt.SigningMethodES256.Alg() {
+		return JWSError{fmt.Errorf("unexpected jws algorithm: %s", header.Alg)}
+	}
+
+	leaf, err := v.verifyChain(header.X5C)
+	if err != nil {
+		return JWSError{err}
+	}
+
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return JWSError{fmt.Errorf("unexpected jws public key: %T", leaf.PublicKey)}
+	}
+	if err := jwt.SigningMethodES256.Verify(parts[0]+"."+parts[1], parts[2], pub); err != nil {
+		return JWSError{fmt.Errorf("invalid jws signature: %v", err)}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return JWSError{fmt.Errorf("unable to decode jws payload: %v", err)}
+	}
+	return json.Unmarshal(payload, obj)
+}
+
+// verifyChain checks x5c certificates chain up to the trusted roots and returns the leaf certificate.
+func (v JWSVerifier) verifyChain(x5c []string) (*x509.Certificate, error) {
+	if len(x5c) == 0 {
+		return nil, errors.New("jws x5c header is missed")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(x5c))
+	for _, str := range x5c {
+		der, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode x5c certificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse x5c certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if err := verifyAppleChain(certs[0], opts); err != nil {
+		return nil, fmt.Errorf("untrusted x5c certificate: %v", err)
+	}
+
+	return certs[0], nil
+}
+
+// DecodeTransaction verifies and decodes signed transaction info.
+func (v JWSVerifier) DecodeTransaction(signed string) (JWSTransaction, error) {
+	var tx JWSTransaction
+	err := v.Verify(signed, &tx)
+	return tx, err
+}
+
+// DecodeRenewalInfo verifies and decodes signed subscription renewal info.
+func (v JWSVerifier) DecodeRenewalInfo(signed string) (JWSRenewalInfo, error) {
+	var ri JWSRenewalInfo
+	err := v.Verify(signed, &ri)
+	return ri, err
+}
+
+// JWSTransaction is decoded signed transaction, see https://developer.apple.com/documentation/appstoreserverapi/jwstransactiondecodedpayload
+// All dates are in milliseconds.
+type JWSTransaction struct {
+	TransactionID               string              `json:"transactionId"`
+	OriginalTransactionID       string              `json:"originalTransactionId"`
+	WebOrderLineItemID          string              `json:"webOrderLineItemId"`
+	BundleID                    string              `json:"bundleId"`
+	ProductID                   string              `json:"productId"`
+	SubscriptionGroupIdentifier string              `json:"subscriptionGroupIdentifier"`
+	Quantity                    int                 `json:"quantity"`
+	Type                        string              `json:"type"`               // Auto-Renewable Subscription | Non-Consumable | Consumable | Non-Renewing Subscription
+	InAppOwnershipType          string              `json:"inAppOwnershipType"` // PURCHASED | FAMILY_SHARED
+	AppAccountToken             string              `json:"appAccountToken"`    // UUID the app set at purchase time
+	Environment                 string              `json:"environment"`        // Sandbox | Production
+	Storefront                  string              `json:"storefront"`
+	TransactionReason           string              `json:"transactionReason"` // PURCHASE | RENEWAL
+	OfferType                   int                 `json:"offerType"`         // 1 - introductory, 2 - promotional, 3 - offer code
+	OfferIdentifier             string              `json:"offerIdentifier"`
+	OfferDiscountType           string              `json:"offerDiscountType"` // FREE_TRIAL | PAY_AS_YOU_GO | PAY_UP_FRONT
+	IsUpgraded                  bool                `json:"isUpgraded"`
+	RevocationReason            *CancellationReason `json:"revocationReason"`
+	Price                       int64               `json:"price"` // in milliunits
+	Currency                    string              `json:"currency"`
+
+	PurchaseDate         Time `json:"purchaseDate"`
+	OriginalPurchaseDate Time `json:"originalPurchaseDate"`
+	ExpiresDate          Time `json:"expiresDate"`
+	RevocationDate       Time `json:"revocationDate"`
+	SignedDate           Time `json:"signedDate"`
+}
+
+// ToInApp converts transaction to verifyReceipt style, so the rest of the package could be used.
+func (tx JWSTransaction) ToInApp() InApp {
+	iap := InApp{
+		WebOrderLineItemID:         tx.WebOrderLineItemID,
+		Quantity:                   tx.Quantity,
+		ProductID:                  tx.ProductID,
+		TransactionID:              tx.TransactionID,
+		OriginalTransactionID:      tx.OriginalTransactionID,
+		PurchaseDate:               tx.PurchaseDate,
+		OriginalPurchaseDate:       tx.OriginalPurchaseDate,
+		CancellationDate:           tx.RevocationDate,
+		SubscriptionExpirationDate: tx.ExpiresDate,
+		SubscriptionTrialPeriod:    tx.OfferDiscountType == "FREE_TRIAL",
+
+		SubscriptionIntroductoryPricePeriod: tx.OfferType == 1 && tx.OfferDiscountType != "FREE_TRIAL",
+	}
+	iap.CancellationReason = tx.RevocationReason
+	return iap
+}
+
+// JWSRenewalInfo is decoded signed renewal info, see https://developer.apple.com/documentation/appstoreserverapi/jwsrenewalinfodecodedpayload
+type JWSRenewalInfo struct {
+	OriginalTransactionID  string           `json:"originalTransactionId"`
+	ProductID              string           `json:"productId"`
+	AutoRenewProductID     string           `json:"autoRenewProductId"`
+	AutoRenewStatus        AutoRenewStatus  `json:"autoRenewStatus"`
+	ExpirationIntent       ExpirationIntent `json:"expirationIntent"`
+	IsInBillingRetryPeriod bool             `json:"isInBillingRetryPeriod"`
+	PriceIncreaseStatus    int              `json:"priceIncreaseStatus"` // 1 - customer consented to price increase
+	OfferType              int              `json:"offerType"`
+	OfferIdentifier        string           `json:"offerIdentifier"`
+	Environment            string           `json:"environment"`
+
+	GracePeriodExpiresDate      Time `json:"gracePeriodExpiresDate"`
+	RecentSubscriptionStartDate Time `json:"recentSubscriptionStartDate"`
+	RenewalDate                 Time `json:"renewalDate"`
+	SignedDate                  Time `json:"signedDate"`
+}
@@ -0,0 +1,357 @@
+package iap
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// ASN.1 field types of app receipt payload according to
+// https://developer.apple.com/library/archive/releasenotes/General/ValidateAppStoreReceipt/Chapters/ReceiptFields.html
+const (
+	asn1BundleID                   = 2
+	asn1ApplicationVersion         = 3
+	asn1OpaqueValue                = 4
+	asn1SHA1Hash                   = 5
+	asn1ReceiptCreationDate        = 12
+	asn1InApp                      = 17
+	asn1OriginalApplicationVersion = 19
+	asn1ReceiptExpirationDate      = 21
+
+	asn1Quantity                            = 1701
+	asn1ProductID                           = 1702
+	asn1TransactionID                       = 1703
+	asn1PurchaseDate                        = 1704
+	asn1OriginalTransactionID               = 1705
+	asn1OriginalPurchaseDate                = 1706
+	asn1SubscriptionExpirationDate          = 1708
+	asn1WebOrderLineItemID                  = 1711
+	asn1CancellationDate                    = 1712
+	asn1SubscriptionTrialPeriod             = 1713
+	asn1SubscriptionIntroductoryPricePeriod = 1719
+)
+
+// ReceiptAttribute ::= SEQUENCE { type INTEGER, version INTEGER, value OCTET STRING }
+type receiptAttribute struct {
+	Type    int
+	Version int
+	Value   []byte
+}
+
+// LocalReceipt is the app receipt decoded on our side, without requesting Apple server.
+type LocalReceipt struct {
+	Receipt
+
+	OpaqueValue  []byte // opaque value used with other data to compute the SHA-1 hash
+	SHA1Hash     []byte // hash used to validate the receipt was issued for the device
+	BundleIDData []byte // bundle id as it's encoded in receipt (DER UTF8String), used to compute the hash
+}
+
+// CheckDeviceHash checks the receipt was issued for the device with given identifierForVendor (UIDevice.identifierForVendor).
+// The receipt hash is SHA-1 of device GUID bytes, opaque value and bundle id, see
+// https://developer.apple.com/library/archive/releasenotes/General/ValidateAppStoreReceipt/Chapters/ValidateLocally.html
+// The check makes sense only for receipt with verified signature.
+func (lr LocalReceipt) CheckDeviceHash(identifierForVendor string) error {
+	guid, err := uuid.FromString(identifierForVendor)
+	if err != nil {
+		return ReceiptDeviceError{fmt.Errorf("invalid identifier for vendor: %v", err)}
+	}
+
+	h := sha1.New()
+	h.Write(guid.Bytes())
+	h.Write(lr.OpaqueValue)
+	h.Write(lr.BundleIDData)
+
+	if len(lr.SHA1Hash) == 0 || !bytes.Equal(h.Sum(nil), lr.SHA1Hash) {
+		return ReceiptDeviceError{errors.New("receipt is issued for another device")}
+	}
+	return nil
+}
+
+// DecodeReceipt decodes base64 PKCS #7 app receipt (the same data that is sent to Apple's verifyReceipt).
+// It doesn't verify the receipt signature, so the result can't be trusted for authorization,
+// though it's handy to screen out garbage before requesting Apple.
+func DecodeReceipt(receipt []byte) (LocalReceipt, error) {
+	sd, err := decodeContainer(receipt)
+	if err != nil {
+		return LocalReceipt{}, err
+	}
+
+	return decodePayload(sd)
+}
+
+// LocalVerifier decodes app receipt locally and checks its PKCS #7 signature chains up to the trusted roots.
+type LocalVerifier struct {
+	// Roots must contain the CA the receipt signing chain (embedded into PKCS #7 container) ends with, the nil pool is rejected.
+	// For production use Apple Inc. Root certificate from https://www.apple.com/certificateauthority/,
+	// the receipts are signed by its WWDR intermediate, see iaptest.Signer for tests.
+	Roots *x509.CertPool
+	// BundleIDs are the apps the receipts are accepted for, it's required.
+	// The receipt of any app is signed by Apple, so the signature alone doesn't prove it's ours.
+	BundleIDs []string
+}
+
+// Verify decodes the base64 receipt and verifies its signature.
+// The certificate chain is checked at the receipt creation date, so old receipts signed by expired intermediate certificate stay valid.
+// Signature failures are returned as ReceiptSignatureError or ReceiptCertificateError,
+// the receipt of unknown app as ReceiptBundleError.
+func (lv LocalVerifier) Verify(receipt []byte) (LocalReceipt, error) {
+	if lv.Roots == nil {
+		return LocalReceipt{}, errors.New("no trusted root certificates are configured")
+	}
+	if len(lv.BundleIDs) == 0 {
+		return LocalReceipt{}, errors.New("no bundle ids are configured")
+	}
+
+	sd, err := decodeContainer(receipt)
+	if err != nil {
+		return LocalReceipt{}, err
+	}
+
+	lr, err := decodePayload(sd)
+	if err != nil {
+		return lr, err
+	}
+
+	certs, err := sd.certificates()
+	if err != nil {
+		return lr, ReceiptCertificateError{fmt.Errorf("unable to parse receipt certificates: %v", err)}
+	}
+
+	signer, err := sd.verifySignature(certs)
+	if err != nil {
+		return lr, ReceiptSignatureError{fmt.Errorf("invalid receipt signature: %v", err)}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if cert != signer {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         lv.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   lr.ReceiptCreationDate.Time,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if err := verifyAppleChain(signer, opts); err != nil {
+		return lr, ReceiptCertificateError{fmt.Errorf("untrusted receipt certificate: %v", err)}
+	}
+
+	for _, bundleID := range lv.BundleIDs {
+		if lr.BundleID == bundleID {
+			return lr, nil
+		}
+	}
+	return lr, ReceiptBundleError{fmt.Errorf("receipt is issued for unexpected app %q", lr.BundleID)}
+}
+
+var (
+	// oidAppleStoreSigning marks the certificate App Store signs receipts, transactions and notifications with.
+	oidAppleStoreSigning = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	// oidAppleWWDR marks Apple Worldwide Developer Relations intermediate certificate.
+	oidAppleWWDR = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+// verifyAppleChain verifies the certificate chains up to the roots through Apple WWDR intermediate
+// and it's App Store signing certificate.
+// The chain alone is not enough: Apple root issues developer certificates through the same intermediate.
+func verifyAppleChain(leaf *x509.Certificate, opts x509.VerifyOptions) error {
+	chains, err := leaf.Verify(opts)
+	if err != nil {
+		return err
+	}
+	if !hasExtension(leaf, oidAppleStoreSigning) {
+		return errors.New("it's not App Store signing certificate")
+	}
+	for _, chain := range chains {
+		if len(chain) > 1 && hasExtension(chain[1], oidAppleWWDR) {
+			return nil
+		}
+	}
+	return errors.New("it's not issued by Apple WWDR intermediate certificate")
+}
+
+func hasExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxReceiptSize is the max size of base64 receipt accepted by DecodeReceipt and LocalVerifier.
+// Real receipts are far smaller even with long transaction history.
+const MaxReceiptSize = 4 << 20
+
+func decodeContainer(receipt []byte) (signedData, error) {
+	if len(receipt) > MaxReceiptSize {
+		return signedData{}, fmt.Errorf("receipt is too large: %d bytes", len(receipt))
+	}
+
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(receipt)))
+	n, err := base64.StdEncoding.Decode(data, receipt)
+	if err != nil {
+		return signedData{}, fmt.Errorf("unable to decode receipt base64: %v", err)
+	}
+
+	sd, err := parsePKCS7(data[:n])
+	if err != nil {
+		return sd, fmt.Errorf("unable to parse receipt container: %v", err)
+	}
+	return sd, nil
+}
+
+func decodePayload(sd signedData) (LocalReceipt, error) {
+	payload, err := sd.content()
+	if err != nil {
+		return LocalReceipt{}, fmt.Errorf("unable to read receipt payload: %v", err)
+	}
+
+	lr, err := parsePayload(payload)
+	if err != nil {
+		return lr, fmt.Errorf("unable to parse receipt payload: %v", err)
+	}
+	return lr, nil
+}
+
+func parsePayload(payload []byte) (LocalReceipt, error) {
+	var lr LocalReceipt
+
+	attrs, err := parseAttributes(payload)
+	if err != nil {
+		return lr, err
+	}
+
+	for _, attr := range attrs {
+		switch attr.Type {
+		case asn1BundleID:
+			lr.BundleIDData = attr.Value
+			err = unmarshalUTF8(attr.Value, &lr.BundleID)
+		case asn1OpaqueValue:
+			lr.OpaqueValue = attr.Value
+		case asn1SHA1Hash:
+			lr.SHA1Hash = attr.Value
+		case asn1ApplicationVersion:
+			err = unmarshalUTF8(attr.Value, &lr.ApplicationVersion)
+		case asn1OriginalApplicationVersion:
+			err = unmarshalUTF8(attr.Value, &lr.OriginalApplicationVersion)
+		case asn1ReceiptCreationDate:
+			err = unmarshalDate(attr.Value, &lr.ReceiptCreationDate)
+		case asn1ReceiptExpirationDate:
+			err = unmarshalDate(attr.Value, &lr.ReceiptExpirationDate)
+		case asn1InApp:
+			var iap InApp
+			iap, err = parseInApp(attr.Value)
+			lr.InApp = append(lr.InApp, iap)
+		}
+		if err != nil {
+			return lr, fmt.Errorf("field type %d: %v", attr.Type, err)
+		}
+	}
+
+	return lr, nil
+}
+
+func parseInApp(payload []byte) (InApp, error) {
+	var iap InApp
+
+	attrs, err := parseAttributes(payload)
+	if err != nil {
+		return iap, err
+	}
+
+	for _, attr := range attrs {
+		switch attr.Type {
+		case asn1Quantity:
+			err = unmarshalInt(attr.Value, &iap.Quantity)
+		case asn1ProductID:
+			err = unmarshalUTF8(attr.Value, &iap.ProductID)
+		case asn1TransactionID:
+			err = unmarshalUTF8(attr.Value, &iap.TransactionID)
+		case asn1OriginalTransactionID:
+			err = unmarshalUTF8(attr.Value, &iap.OriginalTransactionID)
+		case asn1PurchaseDate:
+			err = unmarshalDate(attr.Value, &iap.PurchaseDate)
+		case asn1OriginalPurchaseDate:
+			err = unmarshalDate(attr.Value, &iap.OriginalPurchaseDate)
+		case asn1SubscriptionExpirationDate:
+			err = unmarshalDate(attr.Value, &iap.SubscriptionExpirationDate)
+		case asn1CancellationDate:
+			err = unmarshalDate(attr.Value, &iap.CancellationDate)
+		case asn1WebOrderLineItemID:
+			var id int64
+			err = asn1Unmarshal(attr.Value, &id, "")
+			iap.WebOrderLineItemID = fmt.Sprint(id)
+		case asn1SubscriptionTrialPeriod:
+			err = unmarshalBool(attr.Value, &iap.SubscriptionTrialPeriod)
+		case asn1SubscriptionIntroductoryPricePeriod:
+			err = unmarshalBool(attr.Value, &iap.SubscriptionIntroductoryPricePeriod)
+		}
+		if err != nil {
+			return iap, fmt.Errorf("in-app field type %d: %v", attr.Type, err)
+		}
+	}
+
+	return iap, nil
+}
+
+func parseAttributes(payload []byte) ([]receiptAttribute, error) {
+	var attrs []receiptAttribute
+	err := asn1Unmarshal(payload, &attrs, "set")
+	return attrs, err
+}
+
+func unmarshalUTF8(value []byte, str *string) error {
+	return asn1Unmarshal(value, str, "utf8")
+}
+
+func unmarshalInt(value []byte, i *int) error {
+	return asn1Unmarshal(value, i, "")
+}
+
+func unmarshalBool(value []byte, b *bool) error {
+	var i int
+	err := asn1Unmarshal(value, &i, "")
+	*b = i != 0
+	return err
+}
+
+// dates are IA5STRING interpreted as an RFC 3339 date, the empty string means no date.
+func unmarshalDate(value []byte, t *Time) error {
+	var str string
+	if err := asn1Unmarshal(value, &str, "ia5"); err != nil {
+		return err
+	}
+	if str == "" {
+		return nil
+	}
+
+	tm, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return err
+	}
+	t.Time = tm
+	return nil
+}
+
+func asn1Unmarshal(value []byte, obj interface{}, params string) error {
+	rest, err := asn1.UnmarshalWithParams(value, obj, params)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("trailing data")
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package iap
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap/internal/pkcs7test"
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeReceipt(t *testing.T) {
+	purchase := time.Date(2018, 10, 16, 21, 19, 39, 0, time.UTC)
+	expires := purchase.Add(time.Hour)
+
+	inapp := marshalAttributes(t,
+		utf8Attr(t, asn1ProductID, "com.myfirm.myapp.testsubscript"),
+		utf8Attr(t, asn1TransactionID, "1000000458361822"),
+		utf8Attr(t, asn1OriginalTransactionID, "1000000458361822"),
+		intAttr(t, asn1Quantity, 1),
+		intAttr(t, asn1WebOrderLineItemID, 1000000040842082),
+		intAttr(t, asn1SubscriptionTrialPeriod, 1),
+		dateAttr(t, asn1PurchaseDate, purchase),
+		dateAttr(t, asn1SubscriptionExpirationDate, expires),
+		dateAttr(t, asn1CancellationDate, time.Time{}),
+	)
+	payload := marshalAttributes(t,
+		utf8Attr(t, asn1BundleID, "com.myfirm.myapp"),
+		utf8Attr(t, asn1ApplicationVersion, "46"),
+		dateAttr(t, asn1ReceiptCreationDate, purchase),
+		receiptAttribute{Type: asn1InApp, Version: 1, Value: inapp},
+		receiptAttribute{Type: 1000, Version: 1, Value: []byte("unknown field")},
+	)
+
+	receipt := base64.StdEncoding.EncodeToString(pkcs7test.Sign(payload, nil, nil))
+	lr, err := DecodeReceipt([]byte(receipt))
+	require.NoError(t, err)
+
+	require.Equal(t, "com.myfirm.myapp", lr.BundleID)
+	require.Equal(t, "46", lr.ApplicationVersion)
+	require.True(t, lr.ReceiptCreationDate.Equal(purchase))
+	require.Len(t, lr.InApp, 1)
+
+	iap := lr.InApp[0]
+	require.Equal(t, "com.myfirm.myapp.testsubscript", iap.ProductID)
+	require.Equal(t, "1000000458361822", iap.OriginalTransactionID)
+	require.Equal(t, "1000000040842082", iap.WebOrderLineItemID)
+	require.Equal(t, 1, iap.Quantity)
+	require.True(t, iap.SubscriptionTrialPeriod)
+	require.True(t, iap.SubscriptionExpirationDate.Equal(expires))
+	require.True(t, iap.CancellationDate.IsZero())
+}
+
+func TestDecodeReceiptGarbage(t *testing.T) {
+	testcases := []struct {
+		name    string
+		receipt string
+	}{
+		{"not base64", "%%%"},
+		{"not asn1", base64.StdEncoding.EncodeToString([]byte("garbage"))},
+		{"not pkcs7", base64.StdEncoding.EncodeToString(mustMarshal(t, oidData))},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DecodeReceipt([]byte(tc.receipt))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestBER2DER(t *testing.T) {
+	// SEQUENCE (indefinite) { constructed OCTET STRING (indefinite) { "ab", "c" }, INTEGER 1 }
+	ber := []byte{
+		0x30, 0x80,
+		0x24, 0x80, 0x04, 0x02, 'a', 'b', 0x04, 0x01, 'c', 0x00, 0x00,
+		0x02, 0x01, 0x01,
+		0x00, 0x00,
+	}
+	der, err := ber2der(ber)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x30, 0x08, 0x04, 0x03, 'a', 'b', 'c', 0x02, 0x01, 0x01}, der)
+
+	_, err = ber2der(ber[:len(ber)-2])
+	require.Error(t, err)
+}
+
+func TestBER2DERDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		ber := bytes.Repeat([]byte{0x30, 0x80}, depth)
+		return append(ber, bytes.Repeat([]byte{0x00, 0x00}, depth)...)
+	}
+
+	_, err := ber2der(nested(maxBERDepth))
+	require.NoError(t, err)
+
+	_, err = ber2der(nested(maxBERDepth + 2))
+	require.EqualError(t, err, "ber: too deep nesting")
+
+	// it used to overflow the stack
+	receipt := base64.StdEncoding.EncodeToString(nested(1 << 20))
+	_, err = DecodeReceipt([]byte(receipt))
+	require.Error(t, err)
+
+	receipt = base64.StdEncoding.EncodeToString(nested(2 << 20))
+	_, err = DecodeReceipt([]byte(receipt))
+	require.Contains(t, err.Error(), "too large")
+}
+
+func TestLocalVerifier(t *testing.T) {
+	root, rootKey := pkcs7test.NewCert("Test Root CA", nil, nil)
+	intermediate, intermediateKey := pkcs7test.NewCert("Test WWDR", root, rootKey, oidAppleWWDR)
+	signer, signerKey := pkcs7test.NewCert("Test Mac App Store Receipt Signing", intermediate, intermediateKey, oidAppleStoreSigning)
+	otherRoot, _ := pkcs7test.NewCert("Other Root CA", nil, nil)
+
+	// the certificates chained to the root, but not issued for receipts
+	developer, developerKey := pkcs7test.NewCert("Test Developer", intermediate, intermediateKey)
+	otherCA, otherCAKey := pkcs7test.NewCert("Test Developer ID", root, rootKey)
+	otherSigner, otherSignerKey := pkcs7test.NewCert("Test Receipt Signing", otherCA, otherCAKey, oidAppleStoreSigning)
+
+	rsaSigner, rsaKey := pkcs7test.NewRSACert("Test RSA Receipt Signing", intermediate, intermediateKey, oidAppleStoreSigning)
+
+	payload := marshalAttributes(t,
+		utf8Attr(t, asn1BundleID, "com.myfirm.myapp"),
+		dateAttr(t, asn1ReceiptCreationDate, time.Now()),
+	)
+	signed := pkcs7test.Sign(payload, signerKey, signer, intermediate)
+
+	rsaTampered := pkcs7test.SignWithAttributes(payload, rsaKey, rsaSigner, intermediate)
+	i := bytes.Index(rsaTampered, []byte("com.myfirm.myapp"))
+	rsaTampered[i] = 'C'
+
+	tampered := pkcs7test.Sign(payload, signerKey, signer, intermediate)
+	i = bytes.Index(tampered, []byte("com.myfirm.myapp"))
+	tampered[i] = 'C'
+
+	testcases := []struct {
+		name    string
+		roots   *x509.CertPool
+		receipt []byte
+		expect  error
+	}{
+		{"valid", certPool(root), signed, nil},
+		{"untrusted root", certPool(otherRoot), signed, ReceiptCertificateError{}},
+		{"missing intermediate", certPool(root), pkcs7test.Sign(payload, signerKey, signer), ReceiptCertificateError{}},
+		{"tampered content", certPool(root), tampered, ReceiptSignatureError{}},
+		{"unsigned", certPool(root), pkcs7test.Sign(payload, nil, nil), ReceiptSignatureError{}},
+		{"foreign purpose certificate", certPool(root), pkcs7test.Sign(payload, developerKey, developer, intermediate), ReceiptCertificateError{}},
+		{"foreign intermediate", certPool(root), pkcs7test.Sign(payload, otherSignerKey, otherSigner, otherCA), ReceiptCertificateError{}},
+		{"rsa with authenticated attributes", certPool(root), pkcs7test.SignWithAttributes(payload, rsaKey, rsaSigner, intermediate), nil},
+		{"rsa tampered content", certPool(root), rsaTampered, ReceiptSignatureError{}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			lv := LocalVerifier{Roots: tc.roots, BundleIDs: []string{"com.myfirm.myapp"}}
+			receipt := base64.StdEncoding.EncodeToString(tc.receipt)
+			lr, err := lv.Verify([]byte(receipt))
+			if tc.expect == nil {
+				require.NoError(t, err)
+				require.Equal(t, "com.myfirm.myapp", lr.BundleID)
+				return
+			}
+			require.IsType(t, tc.expect, err)
+		})
+	}
+
+	_, err := LocalVerifier{BundleIDs: []string{"com.myfirm.myapp"}}.Verify([]byte(base64.StdEncoding.EncodeToString(signed)))
+	require.Error(t, err)
+	_, err = LocalVerifier{Roots: certPool(root)}.Verify([]byte(base64.StdEncoding.EncodeToString(signed)))
+	require.Error(t, err)
+	_, err = LocalVerifier{Roots: certPool(root), BundleIDs: []string{"com.myfirm.other"}}.Verify([]byte(base64.StdEncoding.EncodeToString(signed)))
+	require.IsType(t, ReceiptBundleError{}, err)
+}
+
+func TestCheckDeviceHash(t *testing.T) {
+	device := "FC40A4BA-F5B2-4FC0-95E5-1179A9DE7003"
+	opaque := []byte{0x01, 0x02, 0x03, 0x04}
+	bundle := utf8Attr(t, asn1BundleID, "com.myfirm.myapp")
+
+	guid := uuid.FromStringOrNil(device)
+	hash := sha1.Sum(append(append(guid.Bytes(), opaque...), bundle.Value...))
+
+	payload := marshalAttributes(t,
+		bundle,
+		receiptAttribute{Type: asn1OpaqueValue, Version: 1, Value: opaque},
+		receiptAttribute{Type: asn1SHA1Hash, Version: 1, Value: hash[:]},
+	)
+	lr, err := DecodeReceipt([]byte(base64.StdEncoding.EncodeToString(pkcs7test.Sign(payload, nil, nil))))
+	require.NoError(t, err)
+
+	require.NoError(t, lr.CheckDeviceHash(device))
+	require.NoError(t, lr.CheckDeviceHash(strings.ToLower(device)))
+	require.IsType(t, ReceiptDeviceError{}, lr.CheckDeviceHash("6AFEB3A1-2A5B-4E8C-9D3F-2F4A1E7C0B11"))
+	require.IsType(t, ReceiptDeviceError{}, lr.CheckDeviceHash("some-fictional-device-id"))
+}
+
+/************************** fixture helpers **************************/
+
+func certPool(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+func marshalAttributes(t *testing.T, attrs ...receiptAttribute) []byte {
+	data, err := asn1.MarshalWithParams(attrs, "set")
+	require.NoError(t, err)
+	return data
+}
+
+func utf8Attr(t *testing.T, typ int, value string) receiptAttribute {
+	data, err := asn1.MarshalWithParams(value, "utf8")
+	require.NoError(t, err)
+	return receiptAttribute{Type: typ, Version: 1, Value: data}
+}
+
+func intAttr(t *testing.T, typ int, value int64) receiptAttribute {
+	return receiptAttribute{Type: typ, Version: 1, Value: mustMarshal(t, value)}
+}
+
+func dateAttr(t *testing.T, typ int, value time.Time) receiptAttribute {
+	str := ""
+	if !value.IsZero() {
+		str = value.UTC().Format(time.RFC3339)
+	}
+	data, err := asn1.MarshalWithParams(str, "ia5")
+	require.NoError(t, err)
+	return receiptAttribute{Type: typ, Version: 1, Value: data}
+}
+
+func mustMarshal(t *testing.T, obj interface{}) []byte {
+	data, err := asn1.Marshal(obj)
+	require.NoError(t, err)
+	return data
+}
@@ -4,15 +4,9 @@ package iap
 // DSIS - didn't see in sandbox - mark for fields.
 // some of the field is undocumented
 type Notification struct {
-	//	NotificationType:
-	// INITIAL_BUY - Occurs at the initial purchase of the subscription. Store the latest_receipt on your server as a token to verify the user’s subscription status at any time, by validating it with the App Store.
-	// CANCEL - Indicates that the subscription was canceled either by Apple customer support or by the App Store when the user upgraded their subscription. The cancellation_date key contains the date and time when the subscription was canceled or upgraded.
-	// RENEWAL - Indicates successful automatic renewal of an expired subscription that failed to renew in the past. Check subscription_expiraton_date to determine the next renewal date and time.
-	// INTERACTIVE_RENEWAL - Indicates the customer renewed a subscription interactively, either by using your app’s interface, or on the App Store in account settings. Make service available immediately.
-	// DID_CHANGE_RENEWAL_PREF - Indicates the customer made a change in their subscription plan that takes effect at the next renewal. The currently active plan is not affected.
-	// DID_CHANGE_RENEWAL_STATUS - Indicates a change in the subscription renewal status. Check the timestamp for the data and time of the latest status update, and the auto_renew_status for the current renewal status.
+	// see NotificationType constants.
 	// unsubscribe : DID_CHANGE_RENEWAL_STATUS + AutoRenewStatus=false
-	NotificationType string `json:"notification_type"`
+	NotificationType NotificationType `json:"notification_type"`
 
 	Environment           string `json:"environment"`             // PROD | Sandbox
 	Password              string `json:"password"`                // aka shared secret
@@ -33,15 +27,15 @@ type Notification struct {
 	LatestExpiredReceiptInfo InAppV6 `json:"latest_expired_receipt_info"` // DSIS. most recent renewal json. Posted only if the notification_type is RENEWAL or CANCEL or if renewal failed and subscription expired.
 
 	// Check it when DID_CHANGE_RENEWAL_STATUS happend
-	AutoRenewStatus           string `json:"auto_renew_status"`                // false or true. the same as for receipt.
-	AutoRenewStatusChangeDate Time   `json:"auto_renew_status_change_date_ms"` // UNDOCUMENTED
+	AutoRenewStatus           *AutoRenewStatus `json:"auto_renew_status"`                // false or true. the same as for receipt.
+	AutoRenewStatusChangeDate Time             `json:"auto_renew_status_change_date_ms"` // UNDOCUMENTED
 
 	// Check it when DID_CHANGE_RENEWAL_PREF happend
 	AutoRenewProductID string `json:"auto_renew_product_id"` // This is the same as the Subscription Auto Renew Preference in the receipt. See also Receipt Fields.
 	AutoRenewAdamID    string `json:"auto_renew_adam_id"`    // DSIS. The current renewal preference for the auto-renewable subscription. This is the Apple ID of the product.
 
 	// present if RENEWAL or INTERACTIVE_RENEWAL
-	ExpirationIntent string `json:"expiration_intent"` // DSIS. reason of expiration. This is the same as the Subscription Expiration Intent in the receipt. Posted only if notification_type is RENEWAL or INTERACTIVE_RENEWAL. See also Receipt Fields.
+	ExpirationIntent ExpirationIntent `json:"expiration_intent"` // DSIS. reason of expiration. This is the same as the Subscription Expiration Intent in the receipt. Posted only if notification_type is RENEWAL or INTERACTIVE_RENEWAL. See also Receipt Fields.
 }
 
 func (n Notification) GetSupscription() InAppV6 {
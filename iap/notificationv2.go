@@ -0,0 +1,121 @@
+package iap
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// NotificationTypeV2 is the type of App Store Server Notification V2.
+// see https://developer.apple.com/documentation/appstoreservernotifications/notificationtype
+type NotificationTypeV2 string
+
+const (
+	NotificationV2ConsumptionRequest     NotificationTypeV2 = "CONSUMPTION_REQUEST"
+	NotificationV2DidChangeRenewalPref   NotificationTypeV2 = "DID_CHANGE_RENEWAL_PREF"
+	NotificationV2DidChangeRenewalStatus NotificationTypeV2 = "DID_CHANGE_RENEWAL_STATUS"
+	NotificationV2DidFailToRenew         NotificationTypeV2 = "DID_FAIL_TO_RENEW"
+	NotificationV2DidRenew               NotificationTypeV2 = "DID_RENEW"
+	NotificationV2Expired                NotificationTypeV2 = "EXPIRED"
+	NotificationV2GracePeriodExpired     NotificationTypeV2 = "GRACE_PERIOD_EXPIRED"
+	NotificationV2OfferRedeemed          NotificationTypeV2 = "OFFER_REDEEMED"
+	NotificationV2PriceIncrease          NotificationTypeV2 = "PRICE_INCREASE"
+	NotificationV2Refund                 NotificationTypeV2 = "REFUND"
+	NotificationV2RefundDeclined         NotificationTypeV2 = "REFUND_DECLINED"
+	NotificationV2RefundReversed         NotificationTypeV2 = "REFUND_REVERSED"
+	NotificationV2RenewalExtended        NotificationTypeV2 = "RENEWAL_EXTENDED"
+	NotificationV2RenewalExtension       NotificationTypeV2 = "RENEWAL_EXTENSION"
+	NotificationV2Revoke                 NotificationTypeV2 = "REVOKE"
+	NotificationV2Subscribed             NotificationTypeV2 = "SUBSCRIBED"
+	NotificationV2Test                   NotificationTypeV2 = "TEST"
+)
+
+// NotificationSubtype details the NotificationTypeV2, it's empty for some types.
+// see https://developer.apple.com/documentation/appstoreservernotifications/subtype
+type NotificationSubtype string
+
+const (
+	SubtypeInitialBuy        NotificationSubtype = "INITIAL_BUY"
+	SubtypeResubscribe       NotificationSubtype = "RESUBSCRIBE"
+	SubtypeDowngrade         NotificationSubtype = "DOWNGRADE"
+	SubtypeUpgrade           NotificationSubtype = "UPGRADE"
+	SubtypeAutoRenewEnabled  NotificationSubtype = "AUTO_RENEW_ENABLED"
+	SubtypeAutoRenewDisabled NotificationSubtype = "AUTO_RENEW_DISABLED"
+	SubtypeVoluntary         NotificationSubtype = "VOLUNTARY"
+	SubtypeBillingRetry      NotificationSubtype = "BILLING_RETRY"
+	SubtypePriceIncrease     NotificationSubtype = "PRICE_INCREASE"
+	SubtypeGracePeriod       NotificationSubtype = "GRACE_PERIOD"
+	SubtypeBillingRecovery   NotificationSubtype = "BILLING_RECOVERY"
+	SubtypePending           NotificationSubtype = "PENDING"
+	SubtypeAccepted          NotificationSubtype = "ACCEPTED"
+	SubtypeProductNotForSale NotificationSubtype = "PRODUCT_NOT_FOR_SALE"
+	SubtypeSummary           NotificationSubtype = "SUMMARY"
+	SubtypeFailure           NotificationSubtype = "FAILURE"
+	SubtypeUnreported        NotificationSubtype = "UNREPORTED"
+)
+
+// NotificationV2 is the request body of App Store Server Notifications V2.
+// see https://developer.apple.com/documentation/appstoreservernotifications/responsebodyv2
+type NotificationV2 struct {
+	SignedPayload string `json:"signedPayload"`
+}
+
+// NotificationPayloadV2 is the decoded signedPayload.
+// see https://developer.apple.com/documentation/appstoreservernotifications/responsebodyv2decodedpayload
+type NotificationPayloadV2 struct {
+	NotificationType NotificationTypeV2  `json:"notificationType"`
+	Subtype          NotificationSubtype `json:"subtype"`
+	NotificationUUID string              `json:"notificationUUID"` // use it to deduplicate retried notifications
+	Version          string              `json:"version"`
+	SignedDate       Time                `json:"signedDate"`
+	Data             NotificationDataV2  `json:"data"`
+
+	// decoded from Data.SignedTransactionInfo and Data.SignedRenewalInfo, empty if absent
+	Transaction JWSTransaction `json:"-"`
+	RenewalInfo JWSRenewalInfo `json:"-"`
+}
+
+type NotificationDataV2 struct {
+	AppAppleID            int64  `json:"appAppleId"`
+	BundleID              string `json:"bundleId"`
+	BundleVersion         string `json:"bundleVersion"`
+	Environment           string `json:"environment"` // Sandbox | Production
+	Status                int    `json:"status"`      // subscription status, the same as in LastTransaction
+	SignedTransactionInfo string `json:"signedTransactionInfo"`
+	SignedRenewalInfo     string `json:"signedRenewalInfo"`
+}
+
+// DecodeNotification verifies and decodes the request body of App Store Server Notifications V2.
+// The nested transaction and renewal info are verified and decoded as well.
+func (v JWSVerifier) DecodeNotification(body []byte) (NotificationPayloadV2, error) {
+	var payload NotificationPayloadV2
+
+	var n NotificationV2
+	if err := json.Unmarshal(body, &n); err != nil {
+		return payload, err
+	}
+	if n.SignedPayload == "" {
+		return payload, JWSError{errors.New("signedPayload is missed")}
+	}
+
+	if err := v.Verify(n.SignedPayload, &payload); err != nil {
+		return payload, err
+	}
+
+	if payload.Data.SignedTransactionInfo != "" {
+		tx, err := v.DecodeTransaction(payload.Data.SignedTransactionInfo)
+		if err != nil {
+			return payload, err
+		}
+		payload.Transaction = tx
+	}
+
+	if payload.Data.SignedRenewalInfo != "" {
+		ri, err := v.DecodeRenewalInfo(payload.Data.SignedRenewalInfo)
+		if err != nil {
+			return payload, err
+		}
+		payload.RenewalInfo = ri
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,96 @@
+package iap
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Loofort/ios-back/iap/internal/pkcs7test"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeNotification(t *testing.T) {
+	root, rootKey := pkcs7test.NewCert("Test Root CA - G3", nil, nil)
+	intermediate, intermediateKey := pkcs7test.NewCert("Test WWDR - G6", root, rootKey, oidAppleWWDR)
+	leaf, leafKey := pkcs7test.NewCert("Test Prod ECC Mac App Store and iTunes Store Receipt Signing", intermediate, intermediateKey, oidAppleStoreSigning)
+	otherRoot, otherKey := pkcs7test.NewCert("Other Root CA", nil, nil)
+	// chained to the root, but not issued for App Store signing
+	developer, developerKey := pkcs7test.NewCert("Test Developer", intermediate, intermediateKey)
+
+	tx := signJWS(t, leafKey, []*x509.Certificate{leaf, intermediate, root}, map[string]interface{}{
+		"originalTransactionId": "1000000458361822",
+		"productId":             "com.myfirm.myapp.testsubscript",
+		"expiresDate":           3540030136000,
+	})
+	ri := signJWS(t, leafKey, []*x509.Certificate{leaf, intermediate, root}, map[string]interface{}{
+		"originalTransactionId": "1000000458361822",
+		"autoRenewStatus":       0,
+	})
+	body := func(key *ecdsa.PrivateKey, chain ...*x509.Certificate) []byte {
+		payload := signJWS(t, key, chain, map[string]interface{}{
+			"notificationType": "DID_CHANGE_RENEWAL_STATUS",
+			"subtype":          "AUTO_RENEW_DISABLED",
+			"notificationUUID": "002e14d5-51f5-4503-b5a8-c3a1af68eb20",
+			"data": map[string]interface{}{
+				"bundleId":              "com.myfirm.myapp",
+				"signedTransactionInfo": tx,
+				"signedRenewalInfo":     ri,
+			},
+		})
+		data, err := json.Marshal(NotificationV2{payload})
+		require.NoError(t, err)
+		return data
+	}
+
+	v := JWSVerifier{Roots: certPool(root)}
+	n, err := v.DecodeNotification(body(leafKey, leaf, intermediate, root))
+	require.NoError(t, err)
+	require.Equal(t, NotificationV2DidChangeRenewalStatus, n.NotificationType)
+	require.Equal(t, SubtypeAutoRenewDisabled, n.Subtype)
+	require.Equal(t, "com.myfirm.myapp", n.Data.BundleID)
+	require.Equal(t, "com.myfirm.myapp.testsubscript", n.Transaction.ProductID)
+	require.Equal(t, int64(3540030136), n.Transaction.ToInApp().SubscriptionExpirationDate.Unix())
+	require.Equal(t, "1000000458361822", n.RenewalInfo.OriginalTransactionID)
+
+	testcases := []struct {
+		name string
+		body []byte
+	}{
+		{"untrusted chain", body(otherKey, otherRoot)},
+		{"wrong signer", body(intermediateKey, leaf, intermediate)},
+		{"foreign purpose certificate", body(developerKey, developer, intermediate, root)},
+		{"no x5c", body(leafKey)},
+		{"no payload", []byte(`{}`)},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := v.DecodeNotification(tc.body)
+			require.IsType(t, JWSError{}, err)
+		})
+	}
+}
+
+func signJWS(t *testing.T, key *ecdsa.PrivateKey, chain []*x509.Certificate, payload interface{}) string {
+	x5c := []string{}
+	for _, cert := range chain {
+		x5c = append(x5c, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+
+	header, err := json.Marshal(map[string]interface{}{"alg": "ES256", "x5c": x5c})
+	require.NoError(t, err)
+	body, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	signing := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(body),
+	}, ".")
+	signature, err := jwt.SigningMethodES256.Sign(signing, key)
+	require.NoError(t, err)
+
+	return signing + "." + signature
+}
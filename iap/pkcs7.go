@@ -0,0 +1,356 @@
+package iap
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha1" // register hash for crypto.SHA1
+	_ "crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	oidData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// PKCS #7 structures, see https://tools.ietf.org/html/rfc2315
+// Only the subset used by app receipts is implemented.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// parsePKCS7 parses DER (or BER) encoded PKCS #7 signed data container.
+func parsePKCS7(data []byte) (signedData, error) {
+	var sd signedData
+
+	der, err := ber2der(data)
+	if err != nil {
+		return sd, err
+	}
+
+	var info contentInfo
+	rest, err := asn1.Unmarshal(der, &info)
+	if err != nil {
+		return sd, err
+	}
+	if len(rest) > 0 {
+		return sd, errors.New("trailing data after pkcs7 container")
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return sd, fmt.Errorf("unsupported pkcs7 content type: %v", info.ContentType)
+	}
+
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return sd, err
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidData) {
+		return sd, fmt.Errorf("unsupported pkcs7 signed content type: %v", sd.ContentInfo.ContentType)
+	}
+
+	return sd, nil
+}
+
+// content returns the signed payload.
+func (sd signedData) content() ([]byte, error) {
+	var payload []byte
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// maxBERDepth limits nesting of BER elements, app receipts are nested a few levels deep.
+// The limit keeps the recursion from overflowing the stack on crafted input.
+const maxBERDepth = 32
+
+// ber2der converts BER encoding to DER.
+// App receipts are encoded with indefinite length containers, which encoding/asn1 refuses to read.
+func ber2der(ber []byte) ([]byte, error) {
+	der, rest, err := ber2derNode(ber, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("ber: trailing data")
+	}
+	return der, nil
+}
+
+func ber2derNode(ber []byte, depth int) (der []byte, rest []byte, err error) {
+	if depth > maxBERDepth {
+		return nil, nil, errors.New("ber: too deep nesting")
+	}
+	if len(ber) < 2 {
+		return nil, nil, errors.New("ber: truncated element")
+	}
+
+	// identifier octets
+	idlen := 1
+	if ber[0]&0x1f == 0x1f {
+		for {
+			if idlen >= len(ber) {
+				return nil, nil, errors.New("ber: truncated tag")
+			}
+			idlen++
+			if ber[idlen-1]&0x80 == 0 {
+				break
+			}
+		}
+	}
+	identifier := ber[:idlen]
+	constructed := ber[0]&0x20 != 0
+	ber = ber[idlen:]
+
+	// length octets
+	if len(ber) == 0 {
+		return nil, nil, errors.New("ber: truncated length")
+	}
+	indefinite := false
+	length := 0
+	switch l := ber[0]; {
+	case l == 0x80:
+		indefinite = true
+		ber = ber[1:]
+	case l&0x80 == 0:
+		length = int(l)
+		ber = ber[1:]
+	default:
+		n := int(l & 0x7f)
+		if n > 4 || n+1 > len(ber) {
+			return nil, nil, errors.New("ber: invalid length")
+		}
+		for _, b := range ber[1 : n+1] {
+			length = length<<8 | int(b)
+		}
+		ber = ber[n+1:]
+	}
+	if !indefinite && length > len(ber) {
+		return nil, nil, errors.New("ber: truncated content")
+	}
+
+	if !constructed {
+		if indefinite {
+			return nil, nil, errors.New("ber: indefinite length of primitive element")
+		}
+		return encodeTLV(identifier, ber[:length]), ber[length:], nil
+	}
+
+	var content []byte
+	if !indefinite {
+		content, rest = ber[:length], ber[length:]
+	} else {
+		content = ber
+	}
+
+	var children [][]byte
+	for {
+		if indefinite {
+			if len(content) < 2 {
+				return nil, nil, errors.New("ber: missing end-of-contents")
+			}
+			if content[0] == 0 && content[1] == 0 {
+				rest = content[2:]
+				break
+			}
+		} else if len(content) == 0 {
+			break
+		}
+
+		var child []byte
+		child, content, err = ber2derNode(content, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		children = append(children, child)
+	}
+
+	// constructed octet string is chunked, DER requires it to be primitive
+	if len(identifier) == 1 && identifier[0] == 0x24 {
+		var octets []byte
+		for _, child := range children {
+			var chunk []byte
+			if _, err := asn1.Unmarshal(child, &chunk); err != nil {
+				return nil, nil, err
+			}
+			octets = append(octets, chunk...)
+		}
+		return encodeTLV([]byte{0x04}, octets), rest, nil
+	}
+
+	var body []byte
+	for _, child := range children {
+		body = append(body, child...)
+	}
+	return encodeTLV(identifier, body), rest, nil
+}
+
+func encodeTLV(identifier, content []byte) []byte {
+	tlv := append([]byte{}, identifier...)
+
+	l := len(content)
+	switch {
+	case l < 0x80:
+		tlv = append(tlv, byte(l))
+	default:
+		var octets []byte
+		for ; l > 0; l >>= 8 {
+			octets = append([]byte{byte(l)}, octets...)
+		}
+		tlv = append(tlv, 0x80|byte(len(octets)))
+		tlv = append(tlv, octets...)
+	}
+
+	return append(tlv, content...)
+}
+
+var (
+	oidDigestSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidDigestSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// certificates returns certificates embedded into container
+func (sd signedData) certificates() ([]*x509.Certificate, error) {
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, nil
+	}
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
+
+// verifySignature checks the signature of the only signer and returns the signer certificate.
+// It doesn't check the certificate chain.
+func (sd signedData) verifySignature(certs []*x509.Certificate) (*x509.Certificate, error) {
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("expected one signer, got %d", len(sd.SignerInfos))
+	}
+	signer := sd.SignerInfos[0]
+
+	var cert *x509.Certificate
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, signer.IssuerAndSerialNumber.IssuerName.FullBytes) &&
+			c.SerialNumber.Cmp(signer.IssuerAndSerialNumber.SerialNumber) == 0 {
+			cert = c
+			break
+		}
+	}
+	if cert == nil {
+		return nil, errors.New("signer certificate not found")
+	}
+
+	var hash crypto.Hash
+	switch alg := signer.DigestAlgorithm.Algorithm; {
+	case alg.Equal(oidDigestSHA1):
+		hash = crypto.SHA1
+	case alg.Equal(oidDigestSHA256):
+		hash = crypto.SHA256
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm: %v", alg)
+	}
+
+	content, err := sd.content()
+	if err != nil {
+		return nil, err
+	}
+
+	signed := content
+	if len(signer.AuthenticatedAttributes.FullBytes) > 0 {
+		if err := checkAuthenticatedAttributes(signer.AuthenticatedAttributes.Bytes, hash, content); err != nil {
+			return nil, err
+		}
+		// the signature is calculated over DER of SET OF, not of the [0] IMPLICIT tag
+		signed = append([]byte{0x31}, signer.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, hash, digest, signer.EncryptedDigest)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, signer.EncryptedDigest) {
+			err = errors.New("ecdsa verification failure")
+		}
+	default:
+		err = fmt.Errorf("unsupported signer public key: %T", pub)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+func checkAuthenticatedAttributes(data []byte, hash crypto.Hash, content []byte) error {
+	var digest []byte
+	for len(data) > 0 {
+		var attr attribute
+		var err error
+		data, err = asn1.Unmarshal(data, &attr)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case attr.Type.Equal(oidAttributeContentType):
+			var ct asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &ct); err != nil {
+				return err
+			}
+			if !ct.Equal(oidData) {
+				return fmt.Errorf("unexpected signed content type: %v", ct)
+			}
+		case attr.Type.Equal(oidAttributeMessageDigest):
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+				return err
+			}
+		}
+	}
+
+	h := hash.New()
+	h.Write(content)
+	if !bytes.Equal(digest, h.Sum(nil)) {
+		return errors.New("message digest mismatch")
+	}
+	return nil
+}
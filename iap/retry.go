@@ -0,0 +1,261 @@
+package iap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Loofort/ios-back/log"
+)
+
+const (
+	defaultBackoff    = 200 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+	defaultJitter     = 0.2
+)
+
+// DefaultRetryStatuses are verifyReceipt statuses retried besides is_retryable ones (21100-21199):
+// 21005 - the receipt server is not available, 21009 - internal data access error.
+var DefaultRetryStatuses = []int{21005, 21009}
+
+// HTTPError is returned if verifyReceipt replies with unexpected http status.
+type HTTPError struct {
+	error
+	StatusCode int
+	RetryAfter time.Duration // Retry-After header of 429 and 503 replies, 0 if it's absent
+}
+
+// RetryPolicy controls the retries of verifyReceipt request.
+// The zero policy doesn't retry, the total deadline is taken from the context.
+type RetryPolicy struct {
+	MaxRetry int // the number of retries after the first attempt
+
+	// Backoff is the delay before the first retry, it doubles with every retry up to MaxBackoff.
+	// 200ms and 5s by default.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes the delay by ±Jitter fraction, so the instances don't retry in sync.
+	// 0.2 by default, set negative to disable.
+	Jitter float64
+
+	// AttemptTimeout if set, limits every attempt, so the hung request doesn't eat the whole deadline.
+	AttemptTimeout time.Duration
+
+	// Statuses are the retried verifyReceipt statuses besides is_retryable ones, DefaultRetryStatuses if nil.
+	Statuses []int
+	// RetryError decides if the request error is retried.
+	// By default the timeouts (including the attempt timeout), temporary network errors, connection resets
+	// and http 5xx and 429 are. The rest, e.g. dns or tls failures, are not going to pass on retry.
+	RetryError func(err error) bool
+}
+
+// VerifyReceipt sends the receipt to url and retries according to the policy, every attempt is logged.
+// If client == nil the http.Default is used.
+func (p RetryPolicy) VerifyReceipt(ctx context.Context, rreq ReceiptRequest, url string, client *http.Client) (ReceiptResponse, error) {
+	body, err := json.Marshal(rreq)
+	if err != nil {
+		return ReceiptResponse{}, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for retry := 0; ; retry++ {
+		start := time.Now()
+		rresp, err := p.attempt(ctx, body, url, client)
+		retryable := retry < p.MaxRetry && ctx.Err() == nil && p.retryable(rresp, err)
+
+		log.Info(ctx, "verify receipt",
+			"url", url,
+			"attempt", retry+1,
+			"status", rresp.Status,
+			"err", err,
+			"duration", time.Since(start),
+			"retry", retryable,
+			"type", "iap.verify",
+		)
+		if !retryable {
+			return rresp, err
+		}
+
+		var herr HTTPError
+		errors.As(err, &herr)
+		if !p.wait(ctx, retry, herr.RetryAfter) {
+			return rresp, err
+		}
+	}
+}
+
+// wait sleeps the backoff before the retry (counted from 0), but not less than retryAfter asked by the server.
+// It returns false if the retry is pointless: the context is done, or its deadline comes before the delay ends,
+// or the server asks to wait longer than MaxBackoff.
+func (p RetryPolicy) wait(ctx context.Context, retry int, retryAfter time.Duration) bool {
+	maxBackoff := p.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	if retryAfter > maxBackoff {
+		return false
+	}
+
+	delay := p.delay(retry)
+	if delay < retryAfter {
+		delay = retryAfter
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		// no time left for the next attempt
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p RetryPolicy) attempt(ctx context.Context, body []byte, url string, client *http.Client) (ReceiptResponse, error) {
+	rresp := ReceiptResponse{}
+	if p.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.AttemptTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return rresp, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return rresp, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return rresp, HTTPError{
+			fmt.Errorf("unexpected http response code from apple server: %d", resp.StatusCode),
+			resp.StatusCode,
+			retryAfter(resp),
+		}
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&rresp)
+	return rresp, err
+}
+
+func (p RetryPolicy) retryable(rresp ReceiptResponse, err error) bool {
+	if err != nil {
+		return p.retryableError(err)
+	}
+
+	if rresp.Status == 0 {
+		return false
+	}
+	if rresp.IsRetryable {
+		return true
+	}
+
+	statuses := p.Statuses
+	if statuses == nil {
+		statuses = DefaultRetryStatuses
+	}
+	for _, status := range statuses {
+		if rresp.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RetryPolicy) retryableError(err error) bool {
+	if p.RetryError != nil {
+		return p.RetryError(err)
+	}
+	return retryableError(err)
+}
+
+func retryableError(err error) bool {
+	var herr HTTPError
+	if errors.As(err, &herr) {
+		return retryableStatus(herr.StatusCode)
+	}
+	var apierr ServerAPIError
+	if errors.As(err, &apierr) {
+		return retryableStatus(apierr.HTTPStatus)
+	}
+
+	// the attempt timeout is reported as timeout too
+	var nerr net.Error
+	if errors.As(err, &nerr) && (nerr.Timeout() || nerr.Temporary()) {
+		return true
+	}
+	// the server has dropped the connection, e.g. the idle keep-alive one
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryableStatus(code int) bool {
+	return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+}
+
+// retryAfter returns the delay asked by 429 or 503 reply, the header is either seconds or http date.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// delay returns the backoff before the retry (counted from 0) with jitter.
+func (p RetryPolicy) delay(retry int) time.Duration {
+	backoff, maxBackoff, jitter := p.Backoff, p.MaxBackoff, p.Jitter
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	if jitter == 0 {
+		jitter = defaultJitter
+	}
+
+	delay := backoff
+	for i := 0; i < retry && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	if jitter > 0 {
+		delay += time.Duration(float64(delay) * jitter * (2*rand.Float64() - 1))
+	}
+	return delay
+}
@@ -0,0 +1,133 @@
+package iap_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/iap/iaptest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	const receipt = "cmVjZWlwdA=="
+	rreq := iap.ReceiptRequest{ReceiptData: receipt}
+	policy := iap.RetryPolicy{MaxRetry: 2, Backoff: time.Millisecond, AttemptTimeout: 50 * time.Millisecond}
+
+	testcases := []struct {
+		name           string
+		fault          iaptest.Fault
+		receipt        string
+		expectStatus   int
+		expectErr      bool
+		expectAttempts int
+	}{
+		{"no fault", iaptest.Fault{}, receipt, 0, false, 1},
+		{"http 503", iaptest.Fault{HTTPStatus: http.StatusServiceUnavailable, Count: 2}, receipt, 0, false, 3},
+		{"server not available", iaptest.Fault{Status: 21005, Count: 1}, receipt, 0, false, 2},
+		{"is_retryable", iaptest.Fault{Status: 21150, Count: 1}, receipt, 0, false, 2},
+		{"hung attempt", iaptest.Fault{Delay: time.Second, Count: 1}, receipt, 0, false, 2},
+		{"retries exhausted", iaptest.Fault{HTTPStatus: http.StatusBadGateway}, receipt, 0, true, 3},
+		{"http 400 is not retried", iaptest.Fault{HTTPStatus: http.StatusBadRequest}, receipt, 0, true, 1},
+		{"unknown receipt is not retried", iaptest.Fault{}, "dW5rbm93bg==", 21003, false, 1},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			apple := iaptest.NewServer()
+			defer apple.Close()
+			apple.SetReceipt(receipt, iaptest.Receipt{})
+			if tc.fault != (iaptest.Fault{}) {
+				apple.Fail(tc.fault)
+			}
+
+			rresp, err := policy.VerifyReceipt(context.Background(), iap.ReceiptRequest{ReceiptData: tc.receipt}, iap.ProdIAPURL, apple.Client())
+			if tc.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expectStatus, rresp.Status)
+			}
+			require.Len(t, apple.Requests(), tc.expectAttempts)
+		})
+	}
+
+	// the context deadline is shorter than the backoff
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.Fail(iaptest.Fault{HTTPStatus: http.StatusServiceUnavailable})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	slow := iap.RetryPolicy{MaxRetry: 5, Backoff: time.Second, Jitter: -1}
+	start := time.Now()
+	_, err := slow.VerifyReceipt(ctx, rreq, iap.ProdIAPURL, apple.Client())
+	require.IsType(t, iap.HTTPError{}, err)
+	require.Len(t, apple.Requests(), 1)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestRetryAfter(t *testing.T) {
+	rreq := iap.ReceiptRequest{ReceiptData: "cmVjZWlwdA=="}
+	policy := iap.RetryPolicy{MaxRetry: 1, Backoff: time.Millisecond, MaxBackoff: 2 * time.Second}
+
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.SetReceipt(rreq.ReceiptData, iaptest.Receipt{})
+
+	apple.Fail(iaptest.Fault{HTTPStatus: http.StatusTooManyRequests, RetryAfter: time.Second, Count: 1})
+	start := time.Now()
+	_, err := policy.VerifyReceipt(context.Background(), rreq, iap.ProdIAPURL, apple.Client())
+	require.NoError(t, err)
+	require.Len(t, apple.Requests(), 2)
+	require.True(t, time.Since(start) >= time.Second)
+
+	// the server asks to wait longer than the policy allows
+	apple.Fail(iaptest.Fault{HTTPStatus: http.StatusTooManyRequests, RetryAfter: time.Minute, Count: 1})
+	start = time.Now()
+	_, err = policy.VerifyReceipt(context.Background(), rreq, iap.ProdIAPURL, apple.Client())
+	require.Equal(t, time.Minute, err.(iap.HTTPError).RetryAfter)
+	require.Len(t, apple.Requests(), 3)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestRetryError(t *testing.T) {
+	rreq := iap.ReceiptRequest{ReceiptData: "cmVjZWlwdA=="}
+	policy := iap.RetryPolicy{MaxRetry: 2, Backoff: time.Millisecond}
+
+	testcases := []struct {
+		name           string
+		err            error
+		expectAttempts int
+	}{
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, 3},
+		{"closed connection", io.EOF, 3},
+		{"timeout", context.DeadlineExceeded, 3},
+		{"dns failure", &net.DNSError{Err: "no such host", Name: "buy.itunes.apple.com", IsNotFound: true}, 1},
+		{"tls failure", errors.New("x509: certificate signed by unknown authority"), 1},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			client := &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+				attempts++
+				return nil, tc.err
+			})}
+			_, err := policy.VerifyReceipt(context.Background(), rreq, iap.ProdIAPURL, client)
+			require.Error(t, err)
+			require.Equal(t, tc.expectAttempts, attempts)
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,232 @@
+package iap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	ServerAPIURL        = "https://api.storekit.itunes.apple.com"
+	SandboxServerAPIURL = "https://api.storekit-sandbox.itunes.apple.com"
+
+	serverAPIAudience = "appstoreconnect-v1"
+	serverAPITokenTTL = 5 * time.Minute // apple rejects tokens that live more than 60 minutes
+)
+
+// ServerAPIError is returned if App Store Server API responds with non 200 http status.
+type ServerAPIError struct {
+	error
+	HTTPStatus int
+	ErrorCode  int           // apple's error code, e.g. 4040010 - transaction id not found
+	RetryAfter time.Duration // Retry-After header of 429 and 503 replies, 0 if it's absent
+}
+
+// ServerAPI is the client of App Store Server API, the replacement of deprecated verifyReceipt.
+// see https://developer.apple.com/documentation/appstoreserverapi
+// You have to specify the KeyID, IssuerID, BundleID and Key.
+type ServerAPI struct {
+	IsSandbox bool
+	KeyID     string            // in-app purchase key id from App Store Connect
+	IssuerID  string            // issuer id from App Store Connect
+	BundleID  string            // app's bundle id
+	Key       *ecdsa.PrivateKey // in-app purchase private key, it could be loaded by jwt.ParseECPrivateKeyFromPEM
+	MaxRetry  int               // retry if get http status 429 or 5xx, it's used if Retry.MaxRetry is not set
+	Client    *http.Client      // if omit the default is used
+	URL       string            // base url, if omit it's chosen by IsSandbox
+
+	// Retry is the retry policy of the requests, the verifyReceipt statuses are not applied.
+	// Retry-After of 429 reply is honored.
+	Retry RetryPolicy
+}
+
+// HistoryResponse is a response of Get Transaction History.
+type HistoryResponse struct {
+	Revision           string   `json:"revision"` // pass it to the next request to get the next page
+	HasMore            bool     `json:"hasMore"`
+	BundleID           string   `json:"bundleId"`
+	AppAppleID         int64    `json:"appAppleId"`
+	Environment        string   `json:"environment"`        // Sandbox | Production
+	SignedTransactions []string `json:"signedTransactions"` // JWS signed transactions
+}
+
+// StatusResponse is a response of Get All Subscription Statuses.
+type StatusResponse struct {
+	BundleID    string                    `json:"bundleId"`
+	AppAppleID  int64                     `json:"appAppleId"`
+	Environment string                    `json:"environment"`
+	Data        []SubscriptionGroupStatus `json:"data"`
+}
+
+type SubscriptionGroupStatus struct {
+	SubscriptionGroupIdentifier string            `json:"subscriptionGroupIdentifier"`
+	LastTransactions            []LastTransaction `json:"lastTransactions"`
+}
+
+type LastTransaction struct {
+	OriginalTransactionID string `json:"originalTransactionId"`
+
+	// 1 - active, 2 - expired, 3 - in billing retry, 4 - in billing grace period, 5 - revoked.
+	Status int `json:"status"`
+
+	SignedTransactionInfo string `json:"signedTransactionInfo"` // JWS signed transaction
+	SignedRenewalInfo     string `json:"signedRenewalInfo"`     // JWS signed renewal info
+}
+
+// OrderLookupResponse is a response of Look Up Order ID.
+type OrderLookupResponse struct {
+	Status             int      `json:"status"` // 0 - valid order id, 1 - invalid
+	SignedTransactions []string `json:"signedTransactions"`
+}
+
+// RefundHistoryResponse is a response of Get Refund History.
+type RefundHistoryResponse struct {
+	Revision           string   `json:"revision"`
+	HasMore            bool     `json:"hasMore"`
+	SignedTransactions []string `json:"signedTransactions"`
+}
+
+// GetTransactionHistory returns a page of customer's in-app purchase history.
+// The revision is empty for the first page, and taken from previous response for the next.
+func (api ServerAPI) GetTransactionHistory(ctx context.Context, transactionID, revision string) (HistoryResponse, error) {
+	var resp HistoryResponse
+	err := api.get(ctx, "/inApps/v2/history/"+url.PathEscape(transactionID), revisionQuery(revision), &resp)
+	return resp, err
+}
+
+// GetAllSubscriptionStatuses returns the statuses of all customer's subscriptions.
+func (api ServerAPI) GetAllSubscriptionStatuses(ctx context.Context, transactionID string) (StatusResponse, error) {
+	var resp StatusResponse
+	err := api.get(ctx, "/inApps/v1/subscriptions/"+url.PathEscape(transactionID), nil, &resp)
+	return resp, err
+}
+
+// LookUpOrderID returns transactions by order id from the customer's invoice.
+func (api ServerAPI) LookUpOrderID(ctx context.Context, orderID string) (OrderLookupResponse, error) {
+	var resp OrderLookupResponse
+	err := api.get(ctx, "/inApps/v1/lookup/"+url.PathEscape(orderID), nil, &resp)
+	return resp, err
+}
+
+// GetRefundHistory returns a page of refunded transactions of the customer.
+func (api ServerAPI) GetRefundHistory(ctx context.Context, transactionID, revision string) (RefundHistoryResponse, error) {
+	var resp RefundHistoryResponse
+	err := api.get(ctx, "/inApps/v2/refund/lookup/"+url.PathEscape(transactionID), revisionQuery(revision), &resp)
+	return resp, err
+}
+
+func revisionQuery(revision string) url.Values {
+	if revision == "" {
+		return nil
+	}
+	return url.Values{"revision": {revision}}
+}
+
+func (api ServerAPI) get(ctx context.Context, path string, query url.Values, obj interface{}) error {
+	base := api.URL
+	if base == "" {
+		base = ServerAPIURL
+		if api.IsSandbox {
+			base = SandboxServerAPIURL
+		}
+	}
+	u := base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	client := api.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	policy := api.Retry
+	if policy.MaxRetry == 0 {
+		policy.MaxRetry = api.MaxRetry
+	}
+
+	for retry := 0; ; retry++ {
+		err := api.do(ctx, client, u, obj)
+		if err == nil || retry >= policy.MaxRetry || ctx.Err() != nil || !policy.retryableError(err) {
+			return err
+		}
+
+		var apierr ServerAPIError
+		errors.As(err, &apierr)
+		if !policy.wait(ctx, retry, apierr.RetryAfter) {
+			return err
+		}
+	}
+}
+
+func (api ServerAPI) do(ctx context.Context, client *http.Client, u string, obj interface{}) error {
+	token, err := api.token()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req = req.WithContext(ctx)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apierr := struct {
+			ErrorCode    int    `json:"errorCode"`
+			ErrorMessage string `json:"errorMessage"`
+		}{}
+		// error body is optional, e.g. 401 has no body
+		json.NewDecoder(resp.Body).Decode(&apierr)
+
+		return ServerAPIError{
+			fmt.Errorf("unexpected http response code from apple server: %d %s", resp.StatusCode, apierr.ErrorMessage),
+			resp.StatusCode,
+			apierr.ErrorCode,
+			retryAfter(resp),
+		}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(obj)
+}
+
+type serverAPIClaims struct {
+	jwt.StandardClaims
+	BundleID string `json:"bid"`
+}
+
+// token generates bearer token, see https://developer.apple.com/documentation/appstoreserverapi/generating_tokens_for_api_requests
+func (api ServerAPI) token() (string, error) {
+	if api.Key == nil {
+		return "", errors.New("in-app purchase key is missed")
+	}
+
+	now := time.Now()
+	claims := serverAPIClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    api.IssuerID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(serverAPITokenTTL).Unix(),
+			Audience:  serverAPIAudience,
+		},
+		BundleID: api.BundleID,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = api.KeyID
+	return token.SignedString(api.Key)
+}
@@ -0,0 +1,108 @@
+package iap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerAPI(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	calls := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+
+		// check bearer token
+		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		claims := serverAPIClaims{}
+		token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil || token.Method != jwt.SigningMethodES256 || token.Header["kid"] != "KEYID" ||
+			claims.Issuer != "ISSUER" || claims.Audience != serverAPIAudience || claims.BundleID != "com.myfirm.myapp" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/inApps/v2/history/100":
+			if r.URL.Query().Get("revision") != "rev1" {
+				w.Write([]byte(`{"revision":"rev1","hasMore":true,"signedTransactions":["first"]}`))
+				return
+			}
+			w.Write([]byte(`{"revision":"rev2","hasMore":false,"signedTransactions":["second"]}`))
+		case "/inApps/v1/subscriptions/100":
+			if calls[r.URL.Path] == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`{"data":[{"subscriptionGroupIdentifier":"group","lastTransactions":[{"originalTransactionId":"100","status":1}]}]}`))
+		case "/inApps/v1/lookup/BUSY":
+			if calls[r.URL.Path] == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`{"status":0,"signedTransactions":["busy"]}`))
+		case "/inApps/v1/lookup/ORDER":
+			w.Write([]byte(`{"status":0,"signedTransactions":["order"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errorCode":4040010,"errorMessage":"Transaction id not found."}`))
+		}
+	}))
+	defer ts.Close()
+
+	api := ServerAPI{
+		KeyID:    "KEYID",
+		IssuerID: "ISSUER",
+		BundleID: "com.myfirm.myapp",
+		Key:      key,
+		MaxRetry: 1,
+		URL:      ts.URL,
+		Retry:    RetryPolicy{Backoff: time.Millisecond},
+	}
+	ctx := context.Background()
+
+	history, err := api.GetTransactionHistory(ctx, "100", "")
+	require.NoError(t, err)
+	require.True(t, history.HasMore)
+	history, err = api.GetTransactionHistory(ctx, "100", history.Revision)
+	require.NoError(t, err)
+	require.Equal(t, []string{"second"}, history.SignedTransactions)
+
+	statuses, err := api.GetAllSubscriptionStatuses(ctx, "100")
+	require.NoError(t, err)
+	require.Equal(t, 2, calls["/inApps/v1/subscriptions/100"])
+	require.Equal(t, "100", statuses.Data[0].LastTransactions[0].OriginalTransactionID)
+
+	order, err := api.LookUpOrderID(ctx, "ORDER")
+	require.NoError(t, err)
+	require.Equal(t, []string{"order"}, order.SignedTransactions)
+
+	start := time.Now()
+	order, err = api.LookUpOrderID(ctx, "BUSY")
+	require.NoError(t, err)
+	require.Equal(t, []string{"busy"}, order.SignedTransactions)
+	require.True(t, time.Since(start) >= time.Second, "Retry-After is not honored")
+
+	_, err = api.GetRefundHistory(ctx, "404", "")
+	require.IsType(t, ServerAPIError{}, err)
+	require.Equal(t, 4040010, err.(ServerAPIError).ErrorCode)
+	require.Equal(t, 1, calls["/inApps/v2/refund/lookup/404"])
+
+	api.Key = nil
+	_, err = api.LookUpOrderID(ctx, "ORDER")
+	require.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package iap
+
+import (
+	"context"
+)
+
+// Verifier returns the auto-renewable subscriptions of the app receipt normalized to AutoRenewable,
+// whatever the source is: verifyReceipt endpoint, the receipt itself or another store.
+type Verifier interface {
+	// Subscriptions returns the subscriptions in the filter states (all if filter is 0)
+	// and the latest base64 receipt, the passed one if the source has nothing newer.
+	Subscriptions(ctx context.Context, receipt []byte, filter ARState) ([]AutoRenewable, []byte, error)
+}
+
+// VerifierFunc adapts the function to Verifier, use it to plug in another store or a fake in tests.
+type VerifierFunc func(ctx context.Context, receipt []byte, filter ARState) ([]AutoRenewable, []byte, error)
+
+func (f VerifierFunc) Subscriptions(ctx context.Context, receipt []byte, filter ARState) ([]AutoRenewable, []byte, error) {
+	return f(ctx, receipt, filter)
+}
+
+// Subscriptions makes ReceiptService the Verifier backed by the legacy verifyReceipt endpoint,
+// it's GetLatestAutoRenewableIAPs.
+func (rs ReceiptService) Subscriptions(ctx context.Context, receipt []byte, filter ARState) ([]AutoRenewable, []byte, error) {
+	return rs.GetLatestAutoRenewableIAPs(ctx, receipt, filter)
+}
+
+// Subscriptions makes LocalVerifier the Verifier that reads the receipt itself, Apple server is not requested.
+// The receipt knows only the transactions the device has seen, and has no pending renewal info,
+// so there is no billing grace period and the app has to refresh the receipt after the renewal.
+func (lv LocalVerifier) Subscriptions(ctx context.Context, receipt []byte, filter ARState) ([]AutoRenewable, []byte, error) {
+	lr, err := lv.Verify(receipt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var filtered []AutoRenewable
+	for _, sbs := range ExtractAutoRenewable(latestTransactions(lr.InApp)) {
+		if filter == 0 || (sbs.State&filter) > 0 {
+			filtered = append(filtered, sbs)
+		}
+	}
+	return filtered, receipt, nil
+}
+
+// latestTransactions keeps the latest renewal of each auto-renewable subscription,
+// the same way verifyReceipt does with exclude-old-transactions.
+// The purchases without expiration date are not auto-renewable and skipped.
+func latestTransactions(iaps []InApp) []InApp {
+	var latest []InApp
+	index := map[string]int{}
+	for _, p := range iaps {
+		if p.SubscriptionExpirationDate.IsZero() {
+			continue
+		}
+
+		i, ok := index[p.OriginalTransactionID]
+		if !ok {
+			index[p.OriginalTransactionID] = len(latest)
+			latest = append(latest, p)
+			continue
+		}
+		if p.SubscriptionExpirationDate.After(latest[i].SubscriptionExpirationDate.Time) {
+			latest[i] = p
+		}
+	}
+	return latest
+}
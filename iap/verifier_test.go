@@ -0,0 +1,65 @@
+package iap
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/Loofort/ios-back/iap/internal/pkcs7test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalVerifierSubscriptions(t *testing.T) {
+	root, rootKey := pkcs7test.NewCert("Test Root CA", nil, nil)
+	intermediate, intermediateKey := pkcs7test.NewCert("Test WWDR", root, rootKey, oidAppleWWDR)
+	signer, signerKey := pkcs7test.NewCert("Test Mac App Store Receipt Signing", intermediate, intermediateKey, oidAppleStoreSigning)
+
+	now := time.Now()
+	inapp := func(txID, otID string, expires time.Time) receiptAttribute {
+		value := marshalAttributes(t,
+			utf8Attr(t, asn1ProductID, "basic.monthly"),
+			utf8Attr(t, asn1TransactionID, txID),
+			utf8Attr(t, asn1OriginalTransactionID, otID),
+			dateAttr(t, asn1PurchaseDate, expires.Add(-30*24*time.Hour)),
+			dateAttr(t, asn1SubscriptionExpirationDate, expires),
+		)
+		return receiptAttribute{Type: asn1InApp, Version: 1, Value: value}
+	}
+	consumable := marshalAttributes(t,
+		utf8Attr(t, asn1ProductID, "coins"),
+		utf8Attr(t, asn1TransactionID, "4"),
+		utf8Attr(t, asn1OriginalTransactionID, "4"),
+	)
+	payload := marshalAttributes(t,
+		utf8Attr(t, asn1BundleID, "com.myfirm.myapp"),
+		dateAttr(t, asn1ReceiptCreationDate, now),
+		inapp("1", "1", now.Add(-24*time.Hour)),
+		inapp("2", "1", now.Add(24*time.Hour)),
+		inapp("3", "3", now.Add(-time.Hour)),
+		receiptAttribute{Type: asn1InApp, Version: 1, Value: consumable},
+	)
+	receipt := []byte(base64.StdEncoding.EncodeToString(pkcs7test.Sign(payload, signerKey, signer, intermediate)))
+
+	var v Verifier = LocalVerifier{Roots: certPool(root), BundleIDs: []string{"com.myfirm.myapp"}}
+	subscriptions, latest, err := v.Subscriptions(context.Background(), receipt, 0)
+	require.NoError(t, err)
+	require.Equal(t, receipt, latest)
+	require.Len(t, subscriptions, 2)
+	require.Equal(t, "2", subscriptions[0].TransactionID)
+	require.Equal(t, ARActive, subscriptions[0].State)
+	require.Equal(t, ARExpired, subscriptions[1].State)
+
+	subscriptions, _, err = v.Subscriptions(context.Background(), receipt, ARActive)
+	require.NoError(t, err)
+	require.Len(t, subscriptions, 1)
+	require.Equal(t, "1", subscriptions[0].OriginalTransactionID)
+
+	otherRoot, _ := pkcs7test.NewCert("Other Root CA", nil, nil)
+	_, _, err = LocalVerifier{Roots: certPool(otherRoot), BundleIDs: []string{"com.myfirm.myapp"}}.Subscriptions(context.Background(), receipt, 0)
+	require.IsType(t, ReceiptCertificateError{}, err)
+
+	// the receipt of another app is signed by Apple as well
+	_, _, err = LocalVerifier{Roots: certPool(root), BundleIDs: []string{"com.myfirm.other"}}.Subscriptions(context.Background(), receipt, 0)
+	require.IsType(t, ReceiptBundleError{}, err)
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"log"
 	"net/http"
 	"os"
@@ -14,9 +18,13 @@ import (
 )
 
 const (
-	jwtSecret = "jwt secret"
 	jwtPeriod = time.Hour
-	bundleID  = "com.myfirm.myapp"
+	// tolerated clock skew of the api servers
+	jwtLeeway = time.Minute
+	// the tokens are accepted only by the api of this app
+	jwtIssuer   = "https://auth.myfirm.com"
+	jwtAudience = "com.myfirm.myapp.api"
+	bundleID    = "com.myfirm.myapp"
 )
 
 func init() {
@@ -28,22 +36,88 @@ func main() {
 		log.Fatalf("secret is missed, usage:\n%v secret", os.Args[0])
 	}
 
-	rs := iap.ReceiptService{Secret: os.Args[1]}
-	servemux := serveMux(rs)
+	// the breaker stops requests to Apple while it's down, see authHandler.Fallback
+	rs := iap.ReceiptService{Secret: os.Args[1], Breaker: &iap.CircuitBreaker{}}
+	keys, err := newKeySet()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	servemux := serveMux(rs, keys)
 	log.Fatalln(http.ListenAndServe(":8080", servemux))
 }
 
-func serveMux(rs iap.ReceiptService) *http.ServeMux {
-	authHandler := auth.AuthenticationHandler(jwtSecret, jwtPeriod, rs, []string{bundleID}, []string{})
-	apiHandler := auth.IntrospectHandler(jwtSecret, newUserHandler)
+// newKeySet generates the token signing key.
+// The key is lost on restart, in production load it from your secret storage.
+func newKeySet() (auth.KeySet, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return auth.KeySet{}, err
+	}
+	return auth.KeySet{Signing: auth.NewECDSAKey("1", key)}, nil
+}
+
+func serveMux(rs iap.ReceiptService, keys auth.KeySet) *http.ServeMux {
+	// paying users get provisional tokens while Apple is down
+	entitlements := auth.NewMemoryEntitlementCache(3 * 24 * time.Hour)
+	// tokens of refunded subscriptions are rejected before expiration, the expired token is accepted for the leeway
+	revocations := auth.NewMemoryRevocationStore(jwtPeriod + jwtLeeway)
+	authHandler := auth.Authenticator{
+		Keys:         keys,
+		Period:       jwtPeriod,
+		Receipts:     rs,
+		KnownBundles: []string{bundleID},
+		Issuer:       jwtIssuer,
+		Audience:     jwtAudience,
+		Fallback:     entitlements,
+		Revocations:  revocations,
+	}
+	introspector := auth.Introspector{
+		Keys:        keys,
+		Revocations: revocations,
+		Issuer:      jwtIssuer,
+		Audience:    jwtAudience,
+		Leeway:      jwtLeeway,
+	}
+	apiHandler := introspector.Handler(auth.ClaimsBuilder(newUserHandler))
+	// premium api is available only to paid users
+	premiumHandler := introspector.Handler(auth.RequireScopes(newPremiumHandler, auth.ScopeAll))
+	// internal services check tokens here, the endpoint is disabled if the secret is not set
+	introspectHandler := introspector.IntrospectionHandler(map[string]string{
+		"internal": os.Getenv("INTROSPECT_SECRET"),
+	})
+	notificationHandler := iap.NotificationHandler(rs, iap.NotificationCallbacks{
+		InitialBuy:             onNotification,
+		Cancel:                 auth.RevokeOnNotification(revocations, entitlements),
+		Renewal:                onNotification,
+		InteractiveRenewal:     onNotification,
+		DidChangeRenewalPref:   onNotification,
+		DidChangeRenewalStatus: onNotification,
+	})
 
 	mux := &http.ServeMux{}
 	mux.Handle("/token", mw.NewCommonHandler(authHandler))
 	mux.Handle("/user", mw.NewCommonHandler(apiHandler))
+	mux.Handle("/premium", mw.NewCommonHandler(premiumHandler))
+	mux.Handle("/introspect", mw.NewCommonHandler(introspectHandler))
+	mux.Handle("/notification", mw.NewCommonHandler(notificationHandler))
+	// downstream services verify tokens with the published public keys
+	mux.Handle("/.well-known/jwks.json", mw.NewCommonHandler(auth.JWKSHandler(keys)))
 
 	return mux
 }
 
+// onNotification is called on subscription status update.
+// Here you could update your user's state, e.g. revoke access on CANCEL.
+func onNotification(ctx context.Context, n iap.Notification) error {
+	sbs := n.GetSupscription()
+	ilog.Info(ctx, "subscription status update",
+		"notification_type", n.NotificationType,
+		"product_id", sbs.ProductID,
+		"expires", sbs.ExpirationDate.Time,
+	)
+	return nil
+}
+
 /*************************** user API ***************************/
 
 type userAPI struct {
@@ -55,6 +129,10 @@ func newUserHandler(uid string, freebie bool) http.Handler {
 	return userAPI{uid, freebie}
 }
 
+func newPremiumHandler(claims auth.Claims) http.Handler {
+	return userAPI{claims.UID, false}
+}
+
 func (api userAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// enter here only if access token was valied
 	ctx := r.Context()
@@ -2,27 +2,32 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"testing"
+	"time"
 
-	"github.com/Loofort/ios-back/iap"
+	"github.com/Loofort/ios-back/iap/iaptest"
 	"github.com/stretchr/testify/require"
 )
 
 func TestTest(t *testing.T) {
 	// we mock apple server, so we don't need to provide the secret
-	rs := iap.ReceiptService{
-		Client: &http.Client{Transport: &appleMock{}},
-	}
-
-	servemux := serveMux(rs)
+	apple := iaptest.NewServer()
+	defer apple.Close()
+	apple.SetReceipt(receipt, iaptest.NewBuilder(time.Now()).
+		BundleID(bundleID).
+		Subscribe("com.myfirm.myapp.testsubscript", time.Hour, time.Minute).
+		Receipt())
+	rs := apple.ReceiptService()
+
+	keys, err := newKeySet()
+	require.NoError(t, err)
+	servemux := serveMux(rs, keys)
 	ts := httptest.NewServer(servemux)
 	defer ts.Close()
 
@@ -32,7 +37,7 @@ func TestTest(t *testing.T) {
 	token := resp["access_token"].(string)
 
 	// use token
-	req, err := http.NewRequest("GET", ts.URL+"/user", nil)
+	req, err = http.NewRequest("GET", ts.URL+"/user", nil)
 	require.NoError(t, err)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token))
 
@@ -42,15 +47,14 @@ func TestTest(t *testing.T) {
 	}
 }
 
-func tokenRequest(t *testing.T, url string) *http.Request {
-	content, err := ioutil.ReadFile("stub_receipt.json")
-	require.NoError(t, err)
-	receipt := base64.StdEncoding.EncodeToString(content)
+// receipt is the base64 app receipt known to the fake apple server
+const receipt = "cmVjZWlwdA=="
 
+func tokenRequest(t *testing.T, url string) *http.Request {
 	body := new(bytes.Buffer)
 	w := multipart.NewWriter(body)
 
-	err = w.WriteField("bundle_id", bundleID)
+	err := w.WriteField("bundle_id", bundleID)
 	require.NoError(t, err)
 
 	err = w.WriteField("identifier_for_vendor", "some-fictional-device-id")
@@ -87,38 +91,3 @@ func apicall(t *testing.T, req *http.Request) map[string]interface{} {
 
 	return respmap
 }
-
-// appleMock is http transport that mock apple's requests.
-// it decodes base64 request body and return it as a response
-type appleMock struct{}
-
-// Implement http.RoundTripper
-func (t *appleMock) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Create mocked http.Response
-
-	defer req.Body.Close()
-	// preserve request body for debugging purposes
-	//buf := new(bytes.Buffer)
-	//tee := io.TeeReader(req.Body, buf)
-	//req.Body = ioutil.NopCloser(tee)
-	//defer func() { req.Body = ioutil.NopCloser(buf) }()
-
-	rreq := iap.ReceiptRequest{}
-	if err := json.NewDecoder(req.Body).Decode(&rreq); err != nil {
-		return nil, err
-	}
-
-	b, err := base64.StdEncoding.DecodeString(rreq.ReceiptData)
-	if err != nil {
-		return nil, err
-	}
-
-	response := &http.Response{
-		Header:     make(http.Header),
-		Request:    req,
-		StatusCode: http.StatusOK,
-	}
-	response.Header.Set("Content-Type", "application/json")
-	response.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-	return response, nil
-}